@@ -0,0 +1,34 @@
+package cartego
+
+import (
+  "bytes"
+  "errors"
+  "io"
+)
+
+// ErrTooLarge is reported for a tile whose body is larger than
+// Downloader.MaxBodySize.
+var ErrTooLarge = errors.New("tile body too large")
+
+// readBody reads the body of image into memory and closes it. On success Buf
+// is replaced by a reader over the returned bytes; otherwise it is nil.
+func (d *Downloader) readBody(image *Image) ([]byte, error) {
+  body := image.Buf
+  image.Buf = nil
+  defer body.Close()
+
+  var r io.Reader = body
+  if d.MaxBodySize > 0 {
+    r = io.LimitReader(body, d.MaxBodySize+1)
+  }
+
+  buf, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  } else if d.MaxBodySize > 0 && int64(len(buf)) > d.MaxBodySize {
+    return nil, ErrTooLarge
+  }
+
+  image.Buf = io.NopCloser(bytes.NewReader(buf))
+  return buf, nil
+}
@@ -0,0 +1,74 @@
+package cartego
+
+import (
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// CacheInfo holds the HTTP caching headers of a tile, used to revalidate a
+// stored copy instead of downloading it again.
+type CacheInfo struct {
+  ETag string
+  LastModified string
+
+  // Expires is when the provider considers the tile stale, or zero if it
+  // didn't say.
+  Expires time.Time
+}
+
+// setConditional adds the validators in info to req
+func (info *CacheInfo) setConditional(req *http.Request) {
+  if info == nil {
+    return
+  }
+  if info.ETag != "" {
+    req.Header.Set("If-None-Match", info.ETag)
+  }
+  if info.LastModified != "" {
+    req.Header.Set("If-Modified-Since", info.LastModified)
+  }
+}
+
+// cacheInfo reads the caching headers of resp. Headers missing from a 304
+// response are carried over from prev.
+func cacheInfo(resp *http.Response, prev *CacheInfo) (info CacheInfo) {
+  if prev != nil && resp.StatusCode == http.StatusNotModified {
+    info = *prev
+  }
+
+  if etag := resp.Header.Get("ETag"); etag != "" {
+    info.ETag = etag
+  }
+  if lm := resp.Header.Get("Last-Modified"); lm != "" {
+    info.LastModified = lm
+  }
+
+  // max-age takes precedence over Expires
+  if age, ok := maxAge(resp.Header.Get("Cache-Control")); ok {
+    info.Expires = time.Now().Add(age)
+  } else if exp := resp.Header.Get("Expires"); exp != "" {
+    // an invalid date means already expired
+    if t, err := http.ParseTime(exp); err == nil {
+      info.Expires = t
+    } else {
+      info.Expires = time.Now()
+    }
+  }
+
+  return info
+}
+
+func maxAge(cc string) (time.Duration, bool) {
+  for _, directive := range strings.Split(cc, ",") {
+    name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+    if !strings.EqualFold(name, "max-age") {
+      continue
+    }
+    if secs, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+      return time.Duration(secs) * time.Second, true
+    }
+  }
+  return 0, false
+}
@@ -1,26 +1,61 @@
 package cartego
 
 import(
+  "context"
   "io"
+  "iter"
   "net/http"
+  "slices"
+  "sync"
+  "sync/atomic"
   "time"
-  "fmt"
 )
 
-var pause time.Duration
-var batchSize int = 1
-
 type Image struct {
-  Buf io.Reader
+  // Buf is the body of the tile. Whoever receives the Image owns it and
+  // must Close it (or the Image) even if they don't read it, or the
+  // connection it is read from leaks. It is nil when Err is set (unless
+  // Downloader.KeepErrorBody) and for NotModified tiles.
+  Buf io.ReadCloser
   Type string
   Err error
   Tile Tile
+
+  // StatusCode is the HTTP status of the last response, or 0 if there was
+  // none. Responses outside 2xx set Err to a *StatusError.
+  StatusCode int
+
+  // Attempts is the number of requests it took to get this result.
+  Attempts int
+
+  // Cache holds the caching headers of the response.
+  Cache CacheInfo
+
+  // NotModified is set when a conditional request got a 304 response, so
+  // the stored copy is still current. Buf is nil in that case.
+  NotModified bool
+
+  // Strategy is the strategy that served the tile, which for a Failover is
+  // one of its strategies.
+  Strategy Strategy
+
+  // Overzoomed is the number of zoom levels this tile was scaled up from,
+  // when it was made from a lower zoom level's tile (see Overzoom).
+  Overzoomed int
 }
 
 func (i *Image) IsZero() bool {
   return i.Buf == nil
 }
 
+// Close closes the body of the image, if it has one.
+func (i *Image) Close() error {
+  if i.Buf == nil {
+    return nil
+  }
+  return i.Buf.Close()
+}
+
 type Tile struct {
   X, Y, Zoom int
 }
@@ -29,72 +64,399 @@ type Strategy interface {
   GetPath(Tile, int) string
 }
 
-func download(path string, tile Tile, c chan<- *Image, done chan<- bool) {
-  if resp, err := http.Get(path); err != nil {
-    c<-&Image{Err: err, Buf: nil, Type: "", Tile: tile}
-  } else {
-    c<-&Image{resp.Body, resp.Header.Get("Content-Type"), nil, tile}
+// A Downloader fetches tiles with its own settings, so several can be used
+// side by side in one process. The zero value fetches one tile at a time from
+// OpenStreetMaps using http.DefaultClient.
+type Downloader struct {
+  // Strategy builds tile URLs. If nil, OpenStreetMaps is used.
+  Strategy Strategy
+
+  // Client makes the requests. If nil, a client using Transport is used, or
+  // http.DefaultClient if that isn't set either.
+  Client *http.Client
+  Transport http.RoundTripper
+
+  // Header is added to every request. Unless it sets a User-Agent,
+  // UserAgent (or DefaultUserAgent) is sent.
+  Header http.Header
+  UserAgent string
+
+  // Timeout limits each request, including reading its body; TotalTimeout
+  // limits the whole call to Download, including reading the bodies it
+  // delivers until they are closed. Zero means no limit.
+  Timeout time.Duration
+  TotalTimeout time.Duration
+
+  // Concurrency is the number of tiles downloaded at once (at least 1).
+  Concurrency int
+
+  // Pause is the minimum time between the start of two requests.
+  Pause time.Duration
+
+  // Order is the sequence in which tiles passed as a slice are downloaded.
+  Order Order
+
+  // Retries is the number of times a request is repeated after a network
+  // error or a 429 or 5xx response.
+  Retries int
+
+  // RetryWait is the delay before the first retry (1s if unset). It doubles
+  // with every further retry, minus random jitter of up to half.
+  RetryWait time.Duration
+
+  // MaxRetryWait caps the delay between retries (1m if unset), including
+  // delays requested by a Retry-After header.
+  MaxRetryWait time.Duration
+
+  // KeepErrorBody keeps Buf set for non-2xx responses, e.g. to debug error
+  // pages. Otherwise their bodies are discarded.
+  KeepErrorBody bool
+
+  // CacheLookup, if set, returns the caching headers of a stored copy of a
+  // tile, or nil if there is none. Tiles with an ETag or Last-Modified are
+  // requested conditionally and come back NotModified if unchanged.
+  CacheLookup func(Tile) *CacheInfo
+
+  // Progress, if set, is called each time a tile finishes, and again once
+  // the tile's body has been read to the end. Calls are never concurrent, so
+  // it should return quickly.
+  Progress func(Progress)
+
+  // MaxBandwidth caps the bytes per second read from response bodies,
+  // shared by every download this Downloader is running. Zero means no cap.
+  MaxBandwidth int64
+
+  // Validate checks every downloaded tile: it must decode as a complete PNG
+  // or JPEG, match its Content-Type, and not be one of the strategy's known
+  // placeholders (see RegisterPlaceholder). Tiles that fail get a
+  // *ValidationError. Bodies are read into memory for this.
+  Validate bool
+
+  // Overzoom, when validating, replaces invalid tiles with the matching part
+  // of a tile up to Overzoom zoom levels lower, scaled up.
+  Overzoom int
+
+  // Buffer reads each body into memory, closing the connection, before the
+  // Image is delivered, so the receiver can take its time. Bodies larger
+  // than MaxBodySize (if set) fail with ErrTooLarge, whether buffered here or
+  // for validation.
+  Buffer bool
+  MaxBodySize int64
+
+  // Metrics, if set, collects statistics about every request. It may be
+  // shared with other Downloaders.
+  Metrics *Metrics
+
+  mu sync.Mutex
+  bandwidthLimit *limiter
+}
+
+// DefaultDownloader is used by Download and DownloadContext.
+var DefaultDownloader = &Downloader{}
+
+// DefaultUserAgent identifies cartego to tile providers, several of which
+// (e.g. OpenStreetMaps) refuse anonymous requests.
+const DefaultUserAgent = "cartego"
+
+func (d *Downloader) client() *http.Client {
+  if d.Client != nil {
+    return d.Client
+  } else if d.Transport != nil {
+    return &http.Client{Transport: d.Transport}
   }
-  done<-true
+  return http.DefaultClient
 }
 
-func closeWhenDone(c chan<- *Image, exp int, done chan bool) {
-  for i := 0; i < exp; i++ {
-    <-done
+func (d *Downloader) userAgent() string {
+  if d.UserAgent == "" {
+    return DefaultUserAgent
   }
-  close(c)
-  close(done)
+  return d.UserAgent
 }
 
-// Download initiates downloads for the tiles provided using the given strategy.
-func Download(tiles []Tile, strategy Strategy) <-chan *Image {
+func (d *Downloader) concurrency() int {
+  if d.Concurrency < 1 {
+    return 1
+  }
+  return d.Concurrency
+}
+
+// request makes a single attempt at fetching path
+func (d *Downloader) request(ctx context.Context, strategy Strategy, path string, info *CacheInfo) (*http.Response, error) {
+  if err := waitRateLimit(ctx, strategy, path); err != nil {
+    return nil, err
+  }
+
+  cancel := func() {}
+  if d.Timeout > 0 {
+    ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+  }
+
+  req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+  if err != nil {
+    cancel()
+    return nil, err
+  }
+
+  if d.Header != nil {
+    req.Header = d.Header.Clone()
+  }
+  if req.Header.Get("User-Agent") == "" {
+    req.Header.Set("User-Agent", d.userAgent())
+  }
+  info.setConditional(req)
+
+  start := time.Now()
+  resp, err := d.client().Do(req)
+  d.Metrics.request(strategy, req.URL.Host, time.Since(start), resp)
+  if err != nil {
+    cancel()
+    return nil, err
+  }
+
+  // the timeout covers the body too, so it's only released on Close
+  resp.Body = &cancelBody{resp.Body, cancel}
+  if l := d.bandwidth(); l != nil {
+    resp.Body = &throttledBody{resp.Body, ctx, l}
+  }
+  return resp, nil
+}
+
+type cancelBody struct {
+  io.ReadCloser
+  cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+  err := b.ReadCloser.Close()
+  b.cancel()
+  return err
+}
+
+func (d *Downloader) fetch(ctx context.Context, strategy Strategy, path string, tile Tile, info *CacheInfo) *Image {
+  var history []error
+  for attempt := 1; ; attempt++ {
+    resp, err := d.request(ctx, strategy, path, info)
+    if attempt > d.Retries || ctx.Err() != nil || !retryable(resp, err) {
+      image := &Image{Tile: tile, Attempts: attempt}
+      if resp != nil {
+        image.StatusCode = resp.StatusCode
+        image.Type = resp.Header.Get("Content-Type")
+        image.Cache = cacheInfo(resp, info)
+        image.Buf = resp.Body
+        if resp.StatusCode == http.StatusNotModified && info != nil {
+          image.NotModified = true
+          resp.Body.Close()
+          image.Buf = nil
+        } else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+          err = &StatusError{resp.StatusCode, resp.Status}
+          if !d.KeepErrorBody {
+            resp.Body.Close()
+            image.Buf = nil
+          }
+        }
+      }
+
+      if err != nil && len(history) > 0 {
+        err = &RetryError{append(history, err)}
+      }
+      image.Err = err
+      return image
+    }
+
+    d.Metrics.retry(strategy, hostOf(path))
+    wait := d.backoff(attempt)
+    if err != nil {
+      history = append(history, err)
+    } else {
+      history = append(history, &StatusError{resp.StatusCode, resp.Status})
+      if after, ok := retryAfter(resp); ok {
+        wait = min(after, d.maxRetryWait())
+      }
+
+      // drain a little so the connection can be reused
+      io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+      resp.Body.Close()
+    }
+
+    t := time.NewTimer(wait)
+    select {
+    case <-t.C:
+    case <-ctx.Done():
+      t.Stop()
+      return &Image{Err: &RetryError{append(history, ctx.Err())}, Tile: tile, Attempts: attempt}
+    }
+  }
+}
+
+// Download initiates downloads for the tiles provided using d's settings.
+// The returned channel has room for every tile, so the downloads don't wait
+// for it to be received from.
+func (d *Downloader) Download(tiles []Tile) <-chan *Image {
+  return d.DownloadContext(context.Background(), tiles)
+}
+
+// DownloadContext is like Download, but stops when ctx is cancelled.
+// Requests in flight are aborted and tiles not yet started are skipped;
+// the returned channel is closed once the aborted requests have reported.
+func (d *Downloader) DownloadContext(ctx context.Context, tiles []Tile) <-chan *Image {
+  return d.download(ctx, tiles, d.Strategy)
+}
+
+// DownloadSeq is like DownloadContext, but takes tiles one at a time from a
+// sequence, such as one from TileCoords, so the tiles never all have to be in
+// memory. Order is not applied; the tiles are fetched in sequence order.
+// total is the number of tiles in the sequence for progress reports, or -1
+// if it isn't known. The returned channel only has room for as many tiles as
+// are downloaded at once, so the downloads wait for it to be received from.
+func (d *Downloader) DownloadSeq(ctx context.Context, tiles iter.Seq[Tile], total int) <-chan *Image {
+  return d.downloadSeq(ctx, tiles, total, d.Strategy, d.concurrency())
+}
+
+func (d *Downloader) download(ctx context.Context, tiles []Tile, strategy Strategy) <-chan *Image {
+  if d.Order != GivenOrder {
+    tiles = append([]Tile(nil), tiles...)
+    SortTiles(tiles, d.Order)
+  }
+  return d.downloadSeq(ctx, slices.Values(tiles), len(tiles), strategy, len(tiles))
+}
+
+// downloadSeq starts fetching tiles, delivering them on a channel with room
+// for buffer images
+func (d *Downloader) downloadSeq(ctx context.Context, tiles iter.Seq[Tile], total int, strategy Strategy, buffer int) <-chan *Image {
   if strategy == nil {
     strategy = OpenStreetMaps
   }
+  concurrency := d.concurrency()
+  pause := d.Pause
+
+  // the deadline outlives this function: bodies are read after we return
+  var dl *deadline
+  if d.TotalTimeout > 0 {
+    ctx, dl = newDeadline(ctx, d.TotalTimeout)
+  }
+
+  c := make(chan *Image, buffer)
 
-  // we need the second channel so we can close the returned channel
-  // this makes working with channels easier because you can use a for .. range
-  c := make(chan *Image, len(tiles))
-  done := make(chan bool, len(tiles))
+  // each running download holds a slot; the next tile starts as soon as
+  // any slot frees up, but never sooner than pause after the previous one
+  slots := make(chan bool, concurrency)
+  var wg sync.WaitGroup
+  progress := newProgressTracker(d.Progress, total)
 
   go func() {
-    numDone := 0
-    num := 0
-    for i, t := range tiles {
-      go download(strategy.GetPath(t, i), t, c, done)
-      num++
-
-      if num == batchSize {
-        // we've finished this batch, so wait until it's done
-        for {
-          <-done
-
-          num--
-          numDone++
-
-          if numDone == len(tiles) || num == 0 {
-            break
-          }
-        }
+    var last time.Time
+    i := 0
+    for t := range tiles {
+      select {
+      case slots <- true:
+      case <-ctx.Done():
+      }
+      if ctx.Err() != nil {
+        break
+      }
 
-        // if we have more to do, sleep a bit first
-        if numDone < len(tiles) {
-          fmt.Printf("Batch processed: %d/%d\n", numDone, len(tiles))
-          time.Sleep(pause)
+      if wait := pause - time.Since(last); !last.IsZero() && wait > 0 {
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+          break
         }
       }
+      last = time.Now()
+
+      wg.Add(1)
+      go func(srcs []source, t Tile) {
+        defer wg.Done()
+
+        image := d.get(ctx, srcs, t)
+        progress.finished(image)
+        if dl != nil && image.Buf != nil {
+          image.Buf = &cancelBody{image.Buf, dl.hold()}
+        }
+        send(ctx, c, image)
+        <-slots
+      }(sources(strategy, t, i), t)
+      i++
     }
 
-    closeWhenDone(c, len(tiles)-numDone, done)
+    // we close the channel once everything has reported
+    // this makes working with channels easier because you can use a for .. range
+    wg.Wait()
+    close(c)
+    if dl != nil {
+      dl.release()
+    }
   }()
 
   return c
 }
 
+// a deadline cancels the context of a download when it runs out, or once the
+// download has finished and every body it delivered has been closed
+type deadline struct {
+  timer *time.Timer
+  cancel context.CancelFunc
+  // the bodies still open, plus one until the download finishes
+  open atomic.Int64
+}
+
+func newDeadline(ctx context.Context, timeout time.Duration) (context.Context, *deadline) {
+  ctx, cancel := context.WithCancel(ctx)
+  dl := &deadline{timer: time.AfterFunc(timeout, cancel), cancel: cancel}
+  dl.open.Store(1)
+  return ctx, dl
+}
+
+// hold keeps the deadline running for another body until the returned
+// function is called
+func (dl *deadline) hold() context.CancelFunc {
+  dl.open.Add(1)
+  return sync.OnceFunc(dl.release)
+}
+
+func (dl *deadline) release() {
+  if dl.open.Add(-1) == 0 {
+    dl.timer.Stop()
+    dl.cancel()
+  }
+}
+
+// send delivers image unless ctx is done and nobody is receiving, in which
+// case its body is closed so the connection isn't leaked
+func send(ctx context.Context, c chan<- *Image, image *Image) {
+  select {
+  case c<-image:
+    return
+  default:
+  }
+
+  select {
+  case c<-image:
+  case <-ctx.Done():
+    image.Close()
+  }
+}
+
+// Download initiates downloads for the tiles provided using the given strategy
+// and the settings of DefaultDownloader.
+func Download(tiles []Tile, strategy Strategy) <-chan *Image {
+  return DownloadContext(context.Background(), tiles, strategy)
+}
+
+// DownloadContext is like Download, but stops when ctx is cancelled.
+func DownloadContext(ctx context.Context, tiles []Tile, strategy Strategy) <-chan *Image {
+  return DefaultDownloader.download(ctx, tiles, strategy)
+}
+
+// BatchSize sets the concurrency of DefaultDownloader.
 func BatchSize(size int) {
-  batchSize = size
+  DefaultDownloader.Concurrency = size
 }
 
+// Pause sets the minimum gap between requests of DefaultDownloader.
 func Pause(d time.Duration) {
-  pause = d
+  DefaultDownloader.Pause = d
 }
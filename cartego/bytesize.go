@@ -0,0 +1,48 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+)
+
+// byteSize is a flag for sizes like "512KiB", "2MB" or "64k". Binary units
+// (KiB, MiB, ...) and single letters are powers of 1024; KB, MB, ... are
+// powers of 1000. A trailing "/s" is ignored so rates read naturally.
+type byteSize int64
+
+var byteUnits = map[string]int64{
+  "": 1,
+  "b": 1,
+  "k": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+  "m": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+  "g": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+}
+
+func (b *byteSize) String() string {
+  return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+  s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+  num := strings.TrimRightFunc(s, func(r rune) bool {
+    return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == ' '
+  })
+
+  mult, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[len(num):]))]
+  if !ok {
+    return fmt.Errorf("unknown unit in size: %s", s)
+  }
+
+  n, err := strconv.ParseFloat(num, 64)
+  if err != nil || n < 0 {
+    return fmt.Errorf("invalid size: %s", s)
+  }
+  if n * float64(mult) >= math.MaxInt64 {
+    return fmt.Errorf("size too large: %s", s)
+  }
+
+  *b = byteSize(n * float64(mult))
+  return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestByteSize(t *testing.T) {
+  tests := []struct {
+    given string
+    expected byteSize
+    valid bool
+  }{
+    {"0", 0, true},
+    {"512", 512, true},
+    {"512B", 512, true},
+    {"64k", 64 << 10, true},
+    {"512KiB", 512 << 10, true},
+    {"512 KiB", 512 << 10, true},
+    {"2MB", 2e6, true},
+    {"2mb", 2e6, true},
+    {"1.5MiB", 3 << 19, true},
+    {"1GiB/s", 1 << 30, true},
+    {"1gb", 1e9, true},
+    {"10x", 0, false},
+    {"10KiBs", 0, false},
+    {"10TB", 0, false},
+    {"MB", 0, false},
+    {"", 0, false},
+    {"-1KB", 0, false},
+    {"1..5k", 0, false},
+    {"9e18GiB", 0, false},
+    {"8589934592GiB", 0, false},
+  }
+
+  for _, test := range tests {
+    var b byteSize
+    err := b.Set(test.given)
+    if test.valid && err != nil {
+      t.Errorf("given: %q; unexpected error: %v", test.given, err)
+    } else if !test.valid && err == nil {
+      t.Errorf("given: %q; expected an error; actual: %d", test.given, b)
+    } else if b != test.expected {
+      t.Errorf("given: %q; expected: %d; actual: %d", test.given, test.expected, b)
+    }
+  }
+}
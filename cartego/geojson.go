@@ -0,0 +1,123 @@
+package main
+
+import (
+  "cartego"
+  "encoding/json"
+  "fmt"
+  "os"
+)
+
+// geoJSON is any GeoJSON object; only the fields that lead to polygons are
+// decoded
+type geoJSON struct {
+  Type string `json:"type"`
+  Coordinates json.RawMessage `json:"coordinates"`
+  Geometry *geoJSON `json:"geometry"`
+  Geometries []geoJSON `json:"geometries"`
+  Features []geoJSON `json:"features"`
+}
+
+// loadGeoJSON reads the polygons and multipolygons in a GeoJSON file,
+// wherever they are in it. Other geometries are ignored.
+func loadGeoJSON(name string) ([]cartego.Polygon, error) {
+  buf, err := os.ReadFile(name)
+  if err != nil {
+    return nil, err
+  }
+
+  var g geoJSON
+  if err := json.Unmarshal(buf, &g); err != nil {
+    return nil, err
+  }
+
+  polygons, err := g.polygons()
+  if err != nil {
+    return nil, err
+  } else if len(polygons) == 0 {
+    return nil, fmt.Errorf("no polygons in %s", name)
+  }
+  return polygons, nil
+}
+
+func (g *geoJSON) polygons() ([]cartego.Polygon, error) {
+  var ret []cartego.Polygon
+  var err error
+
+  switch g.Type {
+  case "FeatureCollection":
+    for _, f := range g.Features {
+      p, err := f.polygons()
+      if err != nil {
+        return nil, err
+      }
+      ret = append(ret, p...)
+    }
+  case "Feature":
+    if g.Geometry != nil {
+      ret, err = g.Geometry.polygons()
+    }
+  case "GeometryCollection":
+    for _, geom := range g.Geometries {
+      p, err := geom.polygons()
+      if err != nil {
+        return nil, err
+      }
+      ret = append(ret, p...)
+    }
+  case "Polygon":
+    var coords [][][]float64
+    if err = json.Unmarshal(g.Coordinates, &coords); err == nil {
+      var p cartego.Polygon
+      p, err = toPolygon(coords)
+      ret = append(ret, p)
+    }
+  case "MultiPolygon":
+    var coords [][][][]float64
+    if err = json.Unmarshal(g.Coordinates, &coords); err == nil {
+      for _, c := range coords {
+        var p cartego.Polygon
+        if p, err = toPolygon(c); err != nil {
+          break
+        }
+        ret = append(ret, p)
+      }
+    }
+  }
+
+  if err != nil {
+    return nil, fmt.Errorf("invalid %s: %w", g.Type, err)
+  }
+  return ret, nil
+}
+
+// toPolygon converts rings of GeoJSON positions, [lon, lat], to a polygon
+func toPolygon(rings [][][]float64) (cartego.Polygon, error) {
+  p := make(cartego.Polygon, len(rings))
+  for i, ring := range rings {
+    for _, pos := range ring {
+      if len(pos) < 2 {
+        return nil, fmt.Errorf("position with %d coordinates", len(pos))
+      }
+      p[i] = append(p[i], cartego.Point{Lat: pos[1], Lon: pos[0]})
+    }
+  }
+  return p, nil
+}
+
+// multiPolygon converts polygons back to a GeoJSON MultiPolygon
+func multiPolygon(polygons []cartego.Polygon) any {
+  coords := make([][][][2]float64, len(polygons))
+  for i, p := range polygons {
+    coords[i] = make([][][2]float64, len(p))
+    for j, ring := range p {
+      for _, pt := range ring {
+        coords[i][j] = append(coords[i][j], [2]float64{pt.Lon, pt.Lat})
+      }
+    }
+  }
+
+  return struct {
+    Type string `json:"type"`
+    Coordinates [][][][2]float64 `json:"coordinates"`
+  }{"MultiPolygon", coords}
+}
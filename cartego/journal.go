@@ -0,0 +1,174 @@
+package main
+
+import (
+  "bufio"
+  "cartego"
+  "encoding/json"
+  "fmt"
+  "io"
+  "iter"
+  "os"
+  "sync"
+  "time"
+)
+
+// A job describes a download so it can be resumed later.
+type job struct {
+  Lat, Lon, Radius float64
+  // only the tiles within Radius, rather than the square around it
+  Circle bool `json:",omitempty"`
+  // south, west, north and east, if the job covers a box instead of a circle
+  BBox []float64 `json:",omitempty"`
+  // the area, if the job covers polygons, and the file they came from
+  Polygons []cartego.Polygon `json:",omitempty"`
+  GeoJSON string `json:",omitempty"`
+  // the routes and the distance from them in km, if the job covers a
+  // corridor, and the GPX file they came from
+  Paths [][]cartego.Point `json:",omitempty"`
+  Buffer float64 `json:",omitempty"`
+  GPX string `json:",omitempty"`
+  Strategy string
+  MinZoom, MaxZoom int
+  Dir string
+  Started time.Time
+}
+
+const (
+  tileDone = "done"
+  tileFailed = "failed"
+)
+
+// journalEntry records what happened to a tile; tiles without an entry are
+// still pending
+type journalEntry struct {
+  Zoom int `json:"z"`
+  X int `json:"x"`
+  Y int `json:"y"`
+  State string `json:"state"`
+}
+
+// A journal is a newline-delimited JSON file: the job on the first line,
+// followed by an entry for every tile as it finishes. Each line is written as
+// soon as we know it, so the journal survives the process dying.
+type journal struct {
+  sync.Mutex
+  f *os.File
+  enc *json.Encoder
+}
+
+var jobJournal *journal
+
+func createJournal(name string, j *job) (*journal, error) {
+  f, err := os.Create(name)
+  if err != nil {
+    return nil, err
+  }
+
+  jr := &journal{f: f, enc: json.NewEncoder(f)}
+  if err := jr.enc.Encode(j); err != nil {
+    f.Close()
+    return nil, err
+  }
+  return jr, nil
+}
+
+func appendJournal(name string) (*journal, error) {
+  f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  // a line cut short when we died is ended, so it doesn't swallow the first
+  // entry after it; readJournal skips it
+  if err := endLine(f); err != nil {
+    f.Close()
+    return nil, err
+  }
+  return &journal{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// endLine writes a newline to f unless it's empty or already ends with one
+func endLine(f *os.File) error {
+  fi, err := f.Stat()
+  if err != nil || fi.Size() == 0 {
+    return err
+  }
+
+  last := make([]byte, 1)
+  if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+    return err
+  }
+  if last[0] != '\n' {
+    _, err = f.Write([]byte{'\n'})
+  }
+  return err
+}
+
+// readJournal returns the job and the last recorded state of each tile
+func readJournal(name string) (*job, map[cartego.Tile]string, error) {
+  f, err := os.Open(name)
+  if err != nil {
+    return nil, nil, err
+  }
+  defer f.Close()
+
+  // lines aren't limited in length: the job holds the whole area, which for
+  // a GeoJSON polygon or a GPX track can be large
+  r := bufio.NewReader(f)
+  line, err := r.ReadBytes('\n')
+  if err == io.EOF && len(line) == 0 {
+    return nil, nil, fmt.Errorf("empty journal: %s", name)
+  } else if err != nil && err != io.EOF {
+    return nil, nil, err
+  }
+
+  j := &job{}
+  if err := json.Unmarshal(line, j); err != nil {
+    return nil, nil, fmt.Errorf("invalid job in journal %s: %v", name, err)
+  }
+
+  states := make(map[cartego.Tile]string)
+  for {
+    line, err := r.ReadBytes('\n')
+    if len(line) > 0 {
+      var e journalEntry
+      // a line may be cut short if we died while writing it
+      if json.Unmarshal(line, &e) == nil {
+        states[cartego.Tile{Zoom: e.Zoom, X: e.X, Y: e.Y}] = e.State
+      }
+    }
+
+    if err == io.EOF {
+      return j, states, nil
+    } else if err != nil {
+      return nil, nil, err
+    }
+  }
+}
+
+func (jr *journal) Record(t cartego.Tile, state string) {
+  if jr == nil {
+    return
+  }
+
+  jr.Lock()
+  defer jr.Unlock()
+  if err := jr.enc.Encode(journalEntry{t.Zoom, t.X, t.Y, state}); err != nil {
+    fmt.Fprintln(os.Stderr, "Error writing to journal:", err)
+  }
+}
+
+func (jr *journal) Close() error {
+  if jr == nil {
+    return nil
+  }
+  return jr.f.Close()
+}
+
+// removeDone drops the tiles a previous run finished; failed ones are kept so
+// they're retried
+func removeDone(tiles iter.Seq[cartego.Tile], states map[cartego.Tile]string) iter.Seq[cartego.Tile] {
+  return filterTiles(tiles, func(t cartego.Tile) bool {
+    return states[t] != tileDone
+  })
+}
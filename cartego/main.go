@@ -1,11 +1,17 @@
 package main
 
 import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
   "flag"
   "fmt"
-  "io"
+  "iter"
+  "net/http"
+  "net/url"
   "path"
   "os"
+  "os/signal"
   "strconv"
   "strings"
   "cartego"
@@ -22,6 +28,61 @@ var maxZoom int
 var downloadDir string
 var pause time.Duration
 var batchSize int
+var rateLimit float64
+var rateBurst int
+var maxBandwidth byteSize
+var order string
+var validate bool
+var overzoom int
+var maxTileSize byteSize
+var refresh bool
+var journalPath string
+var manifestPath string
+var bbox string
+var geojsonPath string
+var gpxPath string
+var polyline string
+var buffer float64
+var circle bool
+var userAgent string
+var proxy string
+var headers headerFlag = make(headerFlag)
+var placeholders placeholderFlag
+var timeout time.Duration
+var totalTimeout time.Duration
+var retries int
+
+// headerFlag collects repeated -header "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+  return ""
+}
+
+func (h headerFlag) Set(s string) error {
+  name, value, ok := strings.Cut(s, ":")
+  if !ok {
+    return fmt.Errorf("expected \"Name: value\", found: %s", s)
+  }
+  http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+  return nil
+}
+
+// placeholderFlag collects repeated -placeholder SHA-256 sums
+type placeholderFlag [][sha256.Size]byte
+
+func (p *placeholderFlag) String() string {
+  return ""
+}
+
+func (p *placeholderFlag) Set(s string) error {
+  b, err := hex.DecodeString(s)
+  if err != nil || len(b) != sha256.Size {
+    return fmt.Errorf("expected a SHA-256 sum in hex, found: %s", s)
+  }
+  *p = append(*p, [sha256.Size]byte(b))
+  return nil
+}
 
 type cacheLookupTable map[int]map[int]map[int]bool
 var cachedTiles cacheLookupTable = make(map[int]map[int]map[int]bool)
@@ -56,34 +117,61 @@ func init() {
   flag.BoolVar(&runServer, "server", false, "run the server (requires no arguments)")
   flag.IntVar(&port, "port", 5000, "port to run server on; only valid if -server set as well")
   flag.StringVar(&host, "host", "localhost", "hostname to bind server to; only valid if -server set as well")
-  flag.StringVar(&strategy, "strategy", "OpenStreetMaps", "strategy to use (e.g. OpenStreetMaps, Google, Bing, Yahoo, Nokia)")
+  flag.StringVar(&strategy, "strategy", "OpenStreetMaps", "strategy to use (e.g. OpenStreetMaps, Google, Bing, Yahoo, Nokia); a comma-separated list falls back from one to the next, saving fallback tiles in a directory per strategy")
   flag.StringVar(&downloadDir, "dir", "tiles", "directory for tiles; absolute or relative to the working directory")
 
+  flag.StringVar(&userAgent, "user-agent", cartego.DefaultUserAgent, "User-Agent sent to the tile provider")
+  flag.Var(headers, "header", "extra request header as \"Name: value\"; may be repeated")
+  flag.StringVar(&proxy, "proxy", "", "proxy URL; defaults to the HTTP_PROXY and HTTPS_PROXY environment variables")
+  flag.DurationVar(&timeout, "timeout", 30*time.Second, "time limit for each request; 0 for none")
+  flag.DurationVar(&totalTimeout, "total-timeout", 0, "time limit for the whole download; 0 for none")
+  flag.BoolVar(&validate, "validate", false, "check that tiles are complete images and not provider placeholders given with -placeholder")
+  flag.Var(&placeholders, "placeholder", "with -validate, reject tiles with the SHA-256 `sum` given in hex as the provider's placeholder for missing imagery; may be repeated")
+  flag.IntVar(&overzoom, "overzoom", 0, "with -validate, replace invalid tiles by scaling up a tile up to this many zoom levels lower")
+  flag.Var(&maxTileSize, "max-tile-size", "read tiles into memory before saving them, failing any larger than `size`; 0 streams tiles to disk")
+  flag.StringVar(&journalPath, "journal", "", "job journal for resuming an interrupted download; defaults to .cartego-job in -dir")
+  flag.StringVar(&manifestPath, "manifest", "", "record the saved tiles with their SHA-256 sums in the manifest `file`, adding to it if it exists; newline-delimited JSON if it ends in .ndjson or .jsonl")
+  flag.BoolVar(&refresh, "refresh", false, "revalidate cached tiles with the provider and download the ones that changed")
+
+  flag.BoolVar(&circle, "circle", false, "only download the tiles within <rad> of <lat> <lon>, rather than the whole square around the circle")
+  flag.StringVar(&bbox, "bbox", "", "download the box `south,west,north,east` in decimal degrees instead of a circle; west is greater than east for a box crossing the antimeridian")
+  flag.StringVar(&geojsonPath, "geojson", "", "download the tiles intersecting the polygons in a GeoJSON `file` instead of a circle")
+  flag.StringVar(&gpxPath, "gpx", "", "download the tiles along the tracks and routes in a GPX `file` instead of a circle")
+  flag.StringVar(&polyline, "polyline", "", "download the tiles along a route given as an encoded `polyline` (precision 5) instead of a circle")
+  flag.Float64Var(&buffer, "buffer", 0.5, "with -gpx or -polyline, download the tiles within this many km of the route")
   flag.IntVar(&minZoom, "minZoom", 1, fmt.Sprintf("minimum zoom level (%d-%d)", MIN_ZOOM, MAX_ZOOM))
   flag.IntVar(&maxZoom, "maxZoom", 17, fmt.Sprintf("maximum zoom level (%d-%d)", MIN_ZOOM, MAX_ZOOM))
 
-  flag.DurationVar(&pause, "pause", time.Second, "time between batches")
-  flag.IntVar(&batchSize, "batch", CONCURRENT_DOWNLOADS, "maximum number of concurrent downloads in a batch")
+  flag.StringVar(&order, "order", "zoom", "order to download tiles in, lowest zoom first: zoom (column by column), spiral (center outwards) or hilbert")
+  flag.DurationVar(&pause, "pause", time.Second, "minimum time between the start of two requests")
+  flag.IntVar(&batchSize, "batch", CONCURRENT_DOWNLOADS, "maximum number of concurrent downloads")
+  flag.IntVar(&retries, "retries", 2, "number of times to retry a tile after a network error, 429 or 5xx response")
+  flag.Float64Var(&rateLimit, "rate", 0, "maximum requests per second to the tile provider; 0 for no limit")
+  flag.IntVar(&rateBurst, "burst", 1, "maximum burst of requests allowed under -rate")
+  flag.Var(&maxBandwidth, "max-bandwidth", "maximum download `speed` per second, e.g. 512KiB or 2MB; 0 for no limit")
 
   flag.Usage = printUsage
-  flag.Parse()
-
-  cartego.BatchSize(batchSize)
-  cartego.Pause(pause)
 }
 
 func printUsage() {
     fmt.Fprintf(os.Stderr, "Usage:\n\n")
-    fmt.Fprintf(os.Stderr, "\t%s [flags...] <lat> <lon> <rad>\n\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "\t%s [flags...] <lat> <lon> <rad>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "\t%s [flags...] -bbox <south,west,north,east>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "\t%s [flags...] -geojson <file>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "\t%s [flags...] -gpx <file> | -polyline <polyline>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "\t%s [flags...] resume <journal>\n\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "Where:\n\n")
     fmt.Fprintf(os.Stderr, "  lat: latitude in decimal degrees\n")
     fmt.Fprintf(os.Stderr, "  lon: longitude in decimal degrees\n")
-    fmt.Fprintf(os.Stderr, "  rad: radius in kilometers\n\n")
+    fmt.Fprintf(os.Stderr, "  rad: radius in kilometers\n")
+    fmt.Fprintf(os.Stderr, "  journal: journal of an interrupted download (see -journal)\n\n")
     fmt.Fprintf(os.Stderr, "The flags are:\n\n")
     flag.PrintDefaults()
 }
 
 func main() {
+  flag.Parse()
+
   if minZoom < MIN_ZOOM || minZoom > MAX_ZOOM {
     fmt.Fprintf(os.Stderr, "minZoom not within acceptable range. Given: %d\n\n", minZoom)
 
@@ -105,6 +193,13 @@ func main() {
     return
   }
 
+  if _, ok := parseOrder(order); !ok {
+    fmt.Fprintf(os.Stderr, "Unknown order. Given: %s\n\n", order)
+
+    printUsage()
+    return
+  }
+
   if runServer {
     if flag.NArg() > 0 {
       fmt.Fprintf(os.Stderr, "Unexpected arguments to cartego server. Aborting.\n\n")
@@ -115,6 +210,27 @@ func main() {
 
     startServer()
     return
+  } else if flag.NArg() == 2 && flag.Arg(0) == "resume" {
+    resume(flag.Arg(1))
+    return
+  } else if areaFlags() > 0 {
+    if flag.NArg() > 0 || areaFlags() > 1 {
+      fmt.Fprintf(os.Stderr, "Expected only one of <lat> <lon> <rad>, -bbox, -geojson, -gpx and -polyline. Aborting.\n\n")
+
+      printUsage()
+      return
+    }
+
+    j, err := areaJob()
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "Invalid %v\n\n", err)
+
+      printUsage()
+      return
+    }
+
+    start(j)
+    return
   } else if flag.NArg() != 3 {
     fmt.Fprintf(os.Stderr, "Invalid number of arguments. Expected 3, given %d\n\n", flag.NArg())
 
@@ -146,9 +262,45 @@ func main() {
     return
   }
 
-  fmt.Printf("Latitude:  %g°\nLongitude: %g°\nRadius:    %g km\n", lat, lon, rad)
+  start(&job{Lat: lat, Lon: lon, Radius: rad, Circle: circle})
+}
+
+// start downloads the region of j with the settings from the flags
+func start(j *job) {
+  j.Strategy = strategy
+  j.MinZoom, j.MaxZoom = minZoom, maxZoom
+  j.Dir = downloadDir
+  j.Started = time.Now()
+
+  j.printRegion()
+  j.printCircleSavings()
+  if !download(j, nil) {
+    os.Exit(1)
+  }
+}
+
+func resume(name string) {
+  j, states, err := readJournal(name)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, "Error reading journal:", err)
+    os.Exit(1)
+  }
+
+  failed := 0
+  for _, state := range states {
+    if state == tileFailed {
+      failed++
+    }
+  }
 
-  download(lat, lon, rad, minZoom, maxZoom)
+  fmt.Printf("Resuming job started %s\n", j.Started.Format(time.RFC1123))
+  j.printRegion()
+  fmt.Printf("Finished:  %d tiles, %d of them failed\n", len(states), failed)
+
+  journalPath = name
+  if !download(j, states) {
+    os.Exit(1)
+  }
 }
 
 func initOutputDir() error {
@@ -253,12 +405,19 @@ func loadCacheFlat() error {
   }
   defer f.Close()
 
-  tiles, err := f.Readdirnames(-1)
+  tiles, err := f.Readdir(-1)
   if err != nil {
     return err
   }
 
-  for _, name := range tiles {
+  for _, fi := range tiles {
+    // our own metadata files, and the directories of fallback strategies,
+    // whose tiles we'd rather replace from the primary one
+    name := fi.Name()
+    if strings.HasPrefix(name, ".") || fi.IsDir() {
+      continue
+    }
+
     ext := path.Ext(name)
 
     parts := strings.Split(name[:len(name)-len(ext)], "-")
@@ -291,60 +450,203 @@ func loadCacheFlat() error {
   return nil
 }
 
-func removeDuplicates(tiles []cartego.Tile) (ret []cartego.Tile) {
-  for _, t := range tiles {
-    if !cachedTiles.Lookup(t) {
-      ret = append(ret, t)
+// filterTiles passes on the tiles keep returns true for
+func filterTiles(tiles iter.Seq[cartego.Tile], keep func(cartego.Tile) bool) iter.Seq[cartego.Tile] {
+  return func(yield func(cartego.Tile) bool) {
+    for t := range tiles {
+      if keep(t) && !yield(t) {
+        return
+      }
     }
   }
+}
+
+func countTiles(tiles iter.Seq[cartego.Tile]) (n int) {
+  for range tiles {
+    n++
+  }
   return
 }
 
-func save(path string, image *cartego.Image, c chan<- bool) {
-  f, err := os.Create(path)
-  if err != nil {
-    fmt.Fprintln(os.Stderr, "Error writing image to file:", err)
-    return
+func removeDuplicates(tiles iter.Seq[cartego.Tile]) iter.Seq[cartego.Tile] {
+  return filterTiles(tiles, func(t cartego.Tile) bool {
+    return !cachedTiles.Lookup(t)
+  })
+}
+
+func parseStrategy(name string) cartego.Strategy {
+  switch strings.ToLower(name) {
+  case "google":
+    return cartego.Google
+  case "bing":
+    return cartego.Bing
+  case "yahoo":
+    return cartego.Yahoo
+  case "nokia":
+    return cartego.Nokia
+  default:
+    return cartego.OpenStreetMaps
   }
+}
 
-  _, err = io.Copy(f, image.Buf)
-  if err != nil {
-    fmt.Fprintln(os.Stderr, "Error writing image to file:", err)
+// parseOrder returns the order called name, and whether there is one
+func parseOrder(name string) (cartego.Order, bool) {
+  switch strings.ToLower(name) {
+  case "zoom":
+    return cartego.ZoomOrder, true
+  case "spiral":
+    return cartego.SpiralOrder, true
+  case "hilbert":
+    return cartego.HilbertOrder, true
+  default:
+    return cartego.ZoomOrder, false
+  }
+}
+
+// tileFile is where image is stored, relative to downloadDir. Tiles served by
+// a fallback strategy go in a directory named after it, so sources don't mix.
+func tileFile(image *cartego.Image, ext string, primary cartego.Strategy) string {
+  fname := tileKey(image.Tile)+ext
+  if image.Strategy != nil && image.Strategy != primary {
+    return path.Join(cartego.StrategyName(image.Strategy), fname)
   }
-  c<-true
+  return fname
 }
 
-func download(lat, lon, rad float64, minZoom, maxZoom int) {
+// download fetches the tiles of j. If states is set, j is being resumed and
+// holds what happened to its tiles so far. It reports whether every tile was
+// saved.
+func download(j *job, states map[cartego.Tile]string) bool {
+  downloadDir, strategy = j.Dir, j.Strategy
   if err := initOutputDir(); err != nil {
     fmt.Fprintln(os.Stderr, err)
     os.Exit(1)
   }
 
-  tiles := cartego.GetTileCoords(lat, lon, rad * 1000, minZoom, maxZoom)
-  err := loadCacheFlat()
-  if err != nil {
-    fmt.Fprintf(os.Stderr, "Error reading cached tiles, assuming none:", err)
+  if journalPath == "" {
+    journalPath = path.Join(downloadDir, ".cartego-job")
+  }
+
+  var err error
+  if states == nil {
+    jobJournal, err = createJournal(journalPath, j)
   } else {
-    tiles = removeDuplicates(tiles)
+    jobJournal, err = appendJournal(journalPath)
   }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, "Error opening journal:", err)
+    os.Exit(1)
+  }
+  defer jobJournal.Close()
 
-  var strat cartego.Strategy
-  switch strings.ToLower(strategy) {
-  case "google":
-    strat = cartego.Google
-  case "bing":
-    strat = cartego.Bing
-  case "yahoo":
-    strat = cartego.Yahoo
-  case "nokia":
-    strat = cartego.Nokia
-  default:
-    strat = cartego.OpenStreetMaps
+  // tiles are generated as they're needed rather than kept in memory
+  ord, _ := parseOrder(order)
+  tiles := j.tiles(ord)
+  if states != nil {
+    tiles = removeDone(tiles, states)
+  }
+  err = loadCacheFlat()
+  if err != nil {
+    fmt.Fprintln(os.Stderr, "Error reading cached tiles, assuming none:", err)
+  } else if err = tileMetadata.Load(downloadDir); err != nil {
+    fmt.Fprintln(os.Stderr, "Error reading tile metadata:", err)
+  }
+
+  if err == nil {
+    if refresh {
+      tiles = removeFresh(tiles)
+    } else {
+      tiles = removeDuplicates(tiles)
+    }
+  }
+
+  // a list of strategies falls back from one to the next
+  var chain cartego.Failover
+  for _, name := range strings.Split(strategy, ",") {
+    chain = append(chain, parseStrategy(strings.TrimSpace(name)))
   }
 
-  done := make(chan bool, CONCURRENT_DOWNLOADS)
-  c := cartego.Download(tiles, strat)
+  var strat cartego.Strategy = chain
+  if len(chain) == 1 {
+    strat = chain[0]
+  }
+
+  for _, s := range chain {
+    cartego.SetStrategyRateLimit(s, rateLimit, rateBurst)
+  }
+  for _, sum := range placeholders {
+    cartego.RegisterPlaceholder(strat, sum)
+  }
+
+  // on Ctrl-C, requests in flight are aborted and no new tiles are started;
+  // the tiles already delivered are still saved, and the rest stay pending
+  // in the journal
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+  defer stop()
+
+  d := &cartego.Downloader{
+    Strategy: strat,
+    Concurrency: batchSize,
+    Pause: pause,
+    Retries: retries,
+    Progress: printProgress,
+    UserAgent: userAgent,
+    Header: http.Header(headers),
+    Timeout: timeout,
+    TotalTimeout: totalTimeout,
+    MaxBandwidth: int64(maxBandwidth),
+    Metrics: &cartego.Metrics{},
+    Validate: validate,
+    Overzoom: overzoom,
+    Buffer: maxTileSize > 0,
+    MaxBodySize: int64(maxTileSize),
+  }
+  if proxy != "" {
+    u, err := url.Parse(proxy)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, "Invalid proxy URL:", err)
+      os.Exit(1)
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = http.ProxyURL(u)
+    d.Transport = transport
+  }
+  if refresh {
+    d.CacheLookup = tileMetadata.CacheLookup
+  }
+
+  var manifest *manifestFile
+  if manifestPath != "" {
+    manifest, err = createManifest(manifestPath, j, chain[0])
+    if err != nil {
+      fmt.Fprintln(os.Stderr, "Error creating manifest:", err)
+      os.Exit(1)
+    }
+  }
+
+  total := countTiles(tiles)
+  c := d.DownloadSeq(ctx, tiles, total)
+  writer := newSaver(batchSize)
+  if manifest != nil {
+    // tiles are added once save has written them, and dropped if it failed
+    c = manifest.Record(c)
+    writer.manifest = manifest.Manifest
+  }
+  delivered := 0
   for image := range c {
+    delivered++
+    if image.Err != nil {
+      writer.fail(image.Tile, image.Err)
+      continue
+    }
+
+    if image.NotModified {
+      touch(image)
+      jobJournal.Record(image.Tile, tileDone)
+      continue
+    }
+
     ext := ""
 
     switch image.Type {
@@ -356,18 +658,39 @@ func download(lat, lon, rad float64, minZoom, maxZoom int) {
       fmt.Fprintln(os.Stderr, "Unrecognized format, excluding extension:", image.Type)
     }
 
-    fname := fmt.Sprintf("%d-%d-%d", image.Tile.Zoom, image.Tile.X, image.Tile.Y)+ext
-    fpath := path.Join(downloadDir, fname)
+    writer.save(tileFile(image, ext, chain[0]), image)
+  }
+
+  failures := writer.wait()
+  fmt.Fprintln(os.Stderr)
 
-    go save(fpath, image, done)
+  if err := tileMetadata.Save(downloadDir); err != nil {
+    fmt.Fprintln(os.Stderr, "Error writing tile metadata:", err)
   }
 
-  // wait until all tiles have been saved
-  for i := 0; i < len(tiles); i++ {
-    <-done
+  if manifest != nil {
+    if err := manifest.Close(); err != nil {
+      fmt.Fprintln(os.Stderr, "Error writing manifest:", err)
+    }
+  }
+
+  fmt.Println()
+  printMetrics(d.Metrics.Snapshot())
+
+  // tiles that never started when the download was interrupted or ran out
+  // of time are still pending in the journal
+  skipped := total - delivered
+  if len(failures) > 0 || skipped > 0 {
+    printFailures(failures)
+    if skipped > 0 {
+      fmt.Fprintf(os.Stderr, "%d tiles were skipped when the download stopped early.\n", skipped)
+    }
+    fmt.Fprintf(os.Stderr, "Run \"%s resume %s\" to try them again.\n", os.Args[0], journalPath)
+    return false
   }
 
   fmt.Println("Done!")
+  return true
 }
 
 func startServer() {
@@ -0,0 +1,133 @@
+package main
+
+import (
+  "bytes"
+  "cartego"
+  "encoding/json"
+  "fmt"
+  "os"
+  "path"
+  "strings"
+)
+
+// a manifest being written, either streamed or all at once when it's closed
+type manifestFile struct {
+  *cartego.Manifest
+  name string
+  f *os.File
+  stream bool
+}
+
+// createManifest starts the manifest of j at name, or carries on with the
+// one already there, so resuming a job or downloading more tiles into the
+// same directory adds to the record rather than replacing it. A manifest
+// keeps the header of the download that started it, and lists every tile
+// saved by the downloads that used it, but not tiles that were already on
+// disk. Names ending in .ndjson or .jsonl get newline-delimited JSON
+// appended as tiles are saved, where a tile saved again gets another line
+// and the last one counts; anything else gets a single JSON document at the
+// end, where a tile saved again replaces its entry.
+func createManifest(name string, j *job, strategy cartego.Strategy) (*manifestFile, error) {
+  m := &manifestFile{
+    Manifest: &cartego.Manifest{
+      Region: j.region(),
+      Strategy: cartego.StrategyName(strategy),
+      MinZoom: j.MinZoom,
+      MaxZoom: j.MaxZoom,
+      Created: j.Started,
+    },
+    name: name,
+  }
+
+  switch strings.ToLower(path.Ext(name)) {
+  case ".ndjson", ".jsonl":
+    m.stream = true
+  default:
+    f, err := os.Open(name)
+    if os.IsNotExist(err) {
+      return m, nil
+    } else if err != nil {
+      return nil, err
+    }
+    defer f.Close()
+
+    if m.Manifest, err = cartego.ReadManifest(f); err != nil {
+      return nil, fmt.Errorf("reading %s: %w", name, err)
+    }
+    return m, nil
+  }
+
+  f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return nil, err
+  }
+  m.f = f
+
+  fi, err := f.Stat()
+  if err == nil && fi.Size() == 0 {
+    err = m.Stream(f)
+  } else if err == nil {
+    err = m.carryOn(fi.Size())
+  }
+  if err != nil {
+    f.Close()
+    return nil, err
+  }
+  return m, nil
+}
+
+// carryOn takes the header from the newline-delimited JSON of size bytes
+// already in m.f and appends the tiles recorded from now on
+func (m *manifestFile) carryOn(size int64) error {
+  // a line cut off part way would run into the first one appended
+  last := make([]byte, 1)
+  if _, err := m.f.ReadAt(last, size-1); err != nil {
+    return err
+  }
+  if last[0] != '\n' {
+    return fmt.Errorf("%s ends part way through a line", m.name)
+  }
+
+  m.Manifest = new(cartego.Manifest)
+  if err := json.NewDecoder(m.f).Decode(m.Manifest); err != nil {
+    return fmt.Errorf("reading %s: %w", m.name, err)
+  }
+  m.Append(m.f)
+  return nil
+}
+
+func (m *manifestFile) Close() error {
+  if m.stream {
+    err := m.Err()
+    if cerr := m.f.Close(); err == nil {
+      err = cerr
+    }
+    return err
+  }
+
+  // a tile saved again replaces its earlier entry
+  seen := make(map[cartego.Tile]int)
+  tiles := m.Tiles[:0]
+  for _, t := range m.Tiles {
+    key := cartego.Tile{X: t.X, Y: t.Y, Zoom: t.Zoom}
+    if i, ok := seen[key]; ok {
+      tiles[i] = t
+    } else {
+      seen[key] = len(tiles)
+      tiles = append(tiles, t)
+    }
+  }
+  m.Tiles = tiles
+
+  // written to a temporary file first so a failed write doesn't lose the
+  // tiles recorded by earlier downloads
+  var buf bytes.Buffer
+  if err := m.WriteJSON(&buf); err != nil {
+    return err
+  }
+  tmp := m.name + ".tmp"
+  if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, m.name)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+  "cartego"
+  "encoding/json"
+  "fmt"
+  "iter"
+  "os"
+  "path"
+  "sync"
+  "time"
+)
+
+// metadata for the tiles in downloadDir lives in this file, next to the tiles
+const metaFile = ".cartego-cache.json"
+
+// tileMeta is what we remember about a downloaded tile so it can be
+// revalidated later
+type tileMeta struct {
+  File string
+  cartego.CacheInfo
+  Fetched time.Time
+}
+
+type metaStore struct {
+  sync.Mutex
+  tiles map[string]*tileMeta
+}
+
+var tileMetadata = &metaStore{tiles: make(map[string]*tileMeta)}
+
+func tileKey(t cartego.Tile) string {
+  return fmt.Sprintf("%d-%d-%d", t.Zoom, t.X, t.Y)
+}
+
+func (m *metaStore) Load(dir string) error {
+  f, err := os.Open(path.Join(dir, metaFile))
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  m.Lock()
+  defer m.Unlock()
+  return json.NewDecoder(f).Decode(&m.tiles)
+}
+
+// Save writes the metadata to a temporary file first so an interrupted save
+// doesn't lose what we had
+func (m *metaStore) Save(dir string) error {
+  m.Lock()
+  buf, err := json.Marshal(m.tiles)
+  m.Unlock()
+  if err != nil {
+    return err
+  }
+
+  tmp := path.Join(dir, metaFile+".tmp")
+  if err := os.WriteFile(tmp, buf, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path.Join(dir, metaFile))
+}
+
+func (m *metaStore) Get(t cartego.Tile) *tileMeta {
+  m.Lock()
+  defer m.Unlock()
+  return m.tiles[tileKey(t)]
+}
+
+func (m *metaStore) Set(t cartego.Tile, meta *tileMeta) {
+  m.Lock()
+  m.tiles[tileKey(t)] = meta
+  m.Unlock()
+}
+
+// CacheLookup provides the validators for conditional requests
+func (m *metaStore) CacheLookup(t cartego.Tile) *cartego.CacheInfo {
+  if meta := m.Get(t); meta != nil && cachedTiles.Lookup(t) {
+    info := meta.CacheInfo
+    return &info
+  }
+  return nil
+}
+
+// removeFresh drops cached tiles that haven't expired yet
+func removeFresh(tiles iter.Seq[cartego.Tile]) iter.Seq[cartego.Tile] {
+  now := time.Now()
+  return filterTiles(tiles, func(t cartego.Tile) bool {
+    meta := tileMetadata.Get(t)
+    return meta == nil || !cachedTiles.Lookup(t) || !meta.Expires.After(now)
+  })
+}
+
+// touch records that a cached tile was revalidated without changes
+func touch(image *cartego.Image) {
+  meta := tileMetadata.Get(image.Tile)
+  if meta == nil {
+    return
+  }
+
+  now := time.Now()
+  if err := os.Chtimes(path.Join(downloadDir, meta.File), now, now); err != nil {
+    fmt.Fprintln(os.Stderr, "Error updating tile timestamp:", err)
+  }
+  tileMetadata.Set(image.Tile, &tileMeta{File: meta.File, CacheInfo: image.Cache, Fetched: now})
+}
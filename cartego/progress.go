@@ -0,0 +1,59 @@
+package main
+
+import (
+  "cartego"
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// printProgress keeps a single status line up to date on stderr
+func printProgress(p cartego.Progress) {
+  total := p.Completed + p.Failed + p.Remaining
+  fmt.Fprintf(os.Stderr, "\r%d/%d tiles, %d failed, %s, %.1f tiles/s, ETA %v   ",
+    p.Completed+p.Failed, total, p.Failed, formatBytes(p.Bytes), p.Rate, p.ETA.Round(time.Second))
+}
+
+func formatBytes(n int64) string {
+  const unit = 1024
+  if n < unit {
+    return fmt.Sprintf("%d B", n)
+  }
+
+  div, exp := int64(unit), 0
+  for m := n / unit; m >= unit; m /= unit {
+    div *= unit
+    exp++
+  }
+  return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printMetrics prints a table of requests by strategy and host
+func printMetrics(stats []cartego.Stats) {
+  if len(stats) == 0 {
+    return
+  }
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(w, "STRATEGY\tHOST\tREQUESTS\tRETRIES\tERRORS\tSTATUS\tBYTES\tMEAN\tP95\tMAX")
+  for _, s := range stats {
+    codes := make([]int, 0, len(s.Status))
+    for code := range s.Status {
+      codes = append(codes, code)
+    }
+    sort.Ints(codes)
+
+    status := make([]string, len(codes))
+    for i, code := range codes {
+      status[i] = fmt.Sprintf("%d×%d", code, s.Status[code])
+    }
+
+    fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%v\t%v\t%v\n",
+      s.Strategy, s.Host, s.Requests, s.Retries, s.Errors, strings.Join(status, " "), formatBytes(s.Bytes),
+      s.Latency.Mean().Round(time.Millisecond), s.Latency.Quantile(0.95).Round(time.Millisecond), s.Latency.Max.Round(time.Millisecond))
+  }
+  w.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+  "cartego"
+  "fmt"
+  "iter"
+  "strconv"
+  "strings"
+)
+
+// parseBBox parses "south,west,north,east" in decimal degrees
+func parseBBox(s string) ([]float64, error) {
+  parts := strings.Split(s, ",")
+  if len(parts) != 4 {
+    return nil, fmt.Errorf("expected south,west,north,east, found: %s", s)
+  }
+
+  bbox := make([]float64, len(parts))
+  for i, p := range parts {
+    f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+    if err != nil {
+      return nil, fmt.Errorf("expected south,west,north,east, found: %s", s)
+    }
+    bbox[i] = f
+  }
+
+  if bbox[0] > bbox[2] {
+    return nil, fmt.Errorf("south %g is north of north %g", bbox[0], bbox[2])
+  }
+  return bbox, nil
+}
+
+// areaFlags counts the flags given that describe an area other than a circle
+func areaFlags() (n int) {
+  for _, f := range []string{bbox, geojsonPath, gpxPath, polyline} {
+    if f != "" {
+      n++
+    }
+  }
+  return
+}
+
+// areaJob is a job for the area given by the flags rather than a circle
+func areaJob() (*job, error) {
+  if buffer < 0 {
+    return nil, fmt.Errorf("-buffer: negative distance %g", buffer)
+  }
+
+  switch {
+  case gpxPath != "":
+    paths, err := loadGPX(gpxPath)
+    if err != nil {
+      return nil, fmt.Errorf("-gpx: %w", err)
+    }
+    return &job{Paths: paths, Buffer: buffer, GPX: gpxPath}, nil
+  case polyline != "":
+    path, err := decodePolyline(polyline)
+    if err != nil {
+      return nil, fmt.Errorf("-polyline: %w", err)
+    }
+    return &job{Paths: [][]cartego.Point{path}, Buffer: buffer}, nil
+  case bbox != "":
+    box, err := parseBBox(bbox)
+    if err != nil {
+      return nil, fmt.Errorf("-bbox: %w", err)
+    }
+    return &job{BBox: box}, nil
+  }
+
+  polygons, err := loadGeoJSON(geojsonPath)
+  if err != nil {
+    return nil, fmt.Errorf("-geojson: %w", err)
+  }
+  return &job{Polygons: polygons, GeoJSON: geojsonPath}, nil
+}
+
+// tiles yields the tiles j covers, in order o
+func (j *job) tiles(o cartego.Order) iter.Seq[cartego.Tile] {
+  if j.Paths != nil {
+    return cartego.TileCoordsCorridor(j.Paths, j.Buffer * 1000, j.MinZoom, j.MaxZoom, o)
+  } else if j.Polygons != nil {
+    return cartego.TileCoordsPolygon(j.Polygons, j.MinZoom, j.MaxZoom, o)
+  } else if j.BBox != nil {
+    return cartego.TileCoordsBBox(j.BBox[0], j.BBox[1], j.BBox[2], j.BBox[3], j.MinZoom, j.MaxZoom, o)
+  }
+  if j.Circle {
+    return cartego.TileCoordsCircle(j.Lat, j.Lon, j.Radius * 1000, j.MinZoom, j.MaxZoom, o)
+  }
+  return cartego.TileCoords(j.Lat, j.Lon, j.Radius * 1000, j.MinZoom, j.MaxZoom, o)
+}
+
+// printCircleSavings reports how many tiles a circular job leaves out of the
+// square around the circle
+func (j *job) printCircleSavings() {
+  if !j.Circle {
+    return
+  }
+
+  square := countTiles(cartego.TileCoords(j.Lat, j.Lon, j.Radius * 1000, j.MinZoom, j.MaxZoom, cartego.ZoomOrder))
+  circle := countTiles(j.tiles(cartego.ZoomOrder))
+  if square > 0 {
+    fmt.Printf("Circle:    %d tiles, saving %d (%.0f%%) of the square around it\n", circle, square - circle, 100 * float64(square - circle) / float64(square))
+  }
+}
+
+// region describes the area j covers for the manifest
+func (j *job) region() any {
+  if j.Paths != nil {
+    return struct {
+      Route any `json:"route"`
+      Buffer float64 `json:"bufferKm"`
+    }{multiLineString(j.Paths), j.Buffer}
+  } else if j.Polygons != nil {
+    return multiPolygon(j.Polygons)
+  } else if j.BBox != nil {
+    return struct {
+      BBox []float64 `json:"bbox"`
+    }{j.BBox}
+  }
+  return struct {
+    Lat float64 `json:"lat"`
+    Lon float64 `json:"lon"`
+    Radius float64 `json:"radiusKm"`
+  }{j.Lat, j.Lon, j.Radius}
+}
+
+func (j *job) printRegion() {
+  if j.Paths != nil {
+    points := 0
+    for _, path := range j.Paths {
+      points += len(path)
+    }
+    if j.GPX != "" {
+      fmt.Printf("Route:     %d paths of %d points from %s\n", len(j.Paths), points, j.GPX)
+    } else {
+      fmt.Printf("Route:     %d points\n", points)
+    }
+    fmt.Printf("Buffer:    %g km\n", j.Buffer)
+    return
+  } else if j.Polygons != nil {
+    fmt.Printf("Area:      %d polygons from %s\n", len(j.Polygons), j.GeoJSON)
+    return
+  } else if j.BBox != nil {
+    fmt.Printf("South:     %g°\nWest:      %g°\nNorth:     %g°\nEast:      %g°\n", j.BBox[0], j.BBox[1], j.BBox[2], j.BBox[3])
+    return
+  }
+  fmt.Printf("Latitude:  %g°\nLongitude: %g°\nRadius:    %g km\n", j.Lat, j.Lon, j.Radius)
+}
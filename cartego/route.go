@@ -0,0 +1,141 @@
+package main
+
+import (
+  "cartego"
+  "encoding/xml"
+  "fmt"
+  "os"
+)
+
+type gpxPoint struct {
+  Lat float64 `xml:"lat,attr"`
+  Lon float64 `xml:"lon,attr"`
+}
+
+// gpxFile is the tracks and routes of a GPX file
+type gpxFile struct {
+  Tracks []struct {
+    Segments []struct {
+      Points []gpxPoint `xml:"trkpt"`
+    } `xml:"trkseg"`
+  } `xml:"trk"`
+  Routes []struct {
+    Points []gpxPoint `xml:"rtept"`
+  } `xml:"rte"`
+}
+
+// loadGPX reads every track segment and route in a GPX file as a path
+func loadGPX(name string) ([][]cartego.Point, error) {
+  f, err := os.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var g gpxFile
+  if err := xml.NewDecoder(f).Decode(&g); err != nil {
+    return nil, err
+  }
+
+  var paths [][]cartego.Point
+  add := func(points []gpxPoint) {
+    var path []cartego.Point
+    for _, p := range points {
+      path = append(path, cartego.Point{Lat: p.Lat, Lon: p.Lon})
+    }
+    if len(path) > 0 {
+      paths = append(paths, path)
+    }
+  }
+  for _, t := range g.Tracks {
+    for _, s := range t.Segments {
+      add(s.Points)
+    }
+  }
+  for _, r := range g.Routes {
+    add(r.Points)
+  }
+
+  if len(paths) == 0 {
+    return nil, fmt.Errorf("no tracks or routes in %s", name)
+  }
+  return paths, nil
+}
+
+// decodePolyline decodes a path in the encoded polyline format used by
+// Google Maps, OSRM and others, with five decimal places
+func decodePolyline(s string) ([]cartego.Point, error) {
+  var path []cartego.Point
+  var lat, lon int
+
+  // next decodes a single signed value starting at s[i]
+  i := 0
+  next := func() (int, error) {
+    result, shift := 0, 0
+    for {
+      if i >= len(s) {
+        return 0, fmt.Errorf("truncated polyline")
+      }
+      b := int(s[i]) - 63
+      i++
+      if b < 0 || b > 63 {
+        return 0, fmt.Errorf("invalid character %q in polyline", s[i-1])
+      }
+
+      result |= (b & 0x1f) << shift
+      shift += 5
+      if b < 0x20 {
+        break
+      }
+      // no difference in degrees needs more than seven chunks
+      if shift >= 35 {
+        return 0, fmt.Errorf("invalid value in polyline")
+      }
+    }
+
+    if result & 1 != 0 {
+      return ^(result >> 1), nil
+    }
+    return result >> 1, nil
+  }
+
+  for i < len(s) {
+    dlat, err := next()
+    if err != nil {
+      return nil, err
+    }
+    dlon, err := next()
+    if err != nil {
+      return nil, err
+    }
+
+    // garbage or a polyline cut short often still decodes, but rarely stays
+    // on the map
+    lat, lon = lat + dlat, lon + dlon
+    p := cartego.Point{Lat: float64(lat) / 1e5, Lon: float64(lon) / 1e5}
+    if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+      return nil, fmt.Errorf("point %d of polyline is off the map: %v, %v", len(path)+1, p.Lat, p.Lon)
+    }
+    path = append(path, p)
+  }
+
+  if len(path) == 0 {
+    return nil, fmt.Errorf("empty polyline")
+  }
+  return path, nil
+}
+
+// multiLineString converts paths to a GeoJSON MultiLineString
+func multiLineString(paths [][]cartego.Point) any {
+  coords := make([][][2]float64, len(paths))
+  for i, path := range paths {
+    for _, p := range path {
+      coords[i] = append(coords[i], [2]float64{p.Lon, p.Lat})
+    }
+  }
+
+  return struct {
+    Type string `json:"type"`
+    Coordinates [][][2]float64 `json:"coordinates"`
+  }{"MultiLineString", coords}
+}
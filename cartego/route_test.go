@@ -0,0 +1,72 @@
+package main
+
+import (
+  "cartego"
+  "os"
+  "path"
+  "slices"
+  "testing"
+)
+
+func TestDecodePolyline(t *testing.T) {
+  tests := []struct {
+    given string
+    expected []cartego.Point
+    valid bool
+  }{
+    // the example from Google's documentation of the format
+    {"_p~iF~ps|U_ulLnnqC_mqNvxq`@", []cartego.Point{{Lat: 38.5, Lon: -120.2}, {Lat: 40.7, Lon: -120.95}, {Lat: 43.252, Lon: -126.453}}, true},
+    {"??", []cartego.Point{{Lat: 0, Lon: 0}}, true},
+    {"", nil, false},
+    // cut short after a latitude, and part way through a value
+    {"_p~iF~ps|U_ulL", nil, false},
+    {"_p~iF~ps|U_ulLnnq", nil, false},
+    {"_p~iF~ps", nil, false},
+    {"_p~iF ~ps|U", nil, false},
+    {"~~~~~~~~~~??", nil, false},
+    // 91 degrees north
+    {"_mljP?", nil, false},
+  }
+
+  for _, test := range tests {
+    path, err := decodePolyline(test.given)
+    if test.valid && err != nil {
+      t.Errorf("given: %q; unexpected error: %v", test.given, err)
+    } else if !test.valid && err == nil {
+      t.Errorf("given: %q; expected an error; actual: %v", test.given, path)
+    } else if !slices.Equal(path, test.expected) {
+      t.Errorf("given: %q; expected: %v; actual: %v", test.given, test.expected, path)
+    }
+  }
+}
+
+func TestLoadGPX(t *testing.T) {
+  tests := []struct {
+    gpx string
+    expected [][]cartego.Point
+    valid bool
+  }{
+    {`<gpx><trk><trkseg><trkpt lat="1.5" lon="2"/><trkpt lat="1.6" lon="2.1"/></trkseg><trkseg></trkseg><trkseg><trkpt lat="3" lon="4"/></trkseg></trk>` +
+      `<rte><rtept lat="-5" lon="-6"/></rte></gpx>`,
+      [][]cartego.Point{{{Lat: 1.5, Lon: 2}, {Lat: 1.6, Lon: 2.1}}, {{Lat: 3, Lon: 4}}, {{Lat: -5, Lon: -6}}}, true},
+    {`<gpx><wpt lat="1" lon="2"/></gpx>`, nil, false},
+    {`<gpx><trk><trkseg><trkpt lat="1" lon="2"/>`, nil, false},
+    {`not xml`, nil, false},
+  }
+
+  for i, test := range tests {
+    name := path.Join(t.TempDir(), "route.gpx")
+    if err := os.WriteFile(name, []byte(test.gpx), 0644); err != nil {
+      t.Fatal(err)
+    }
+
+    paths, err := loadGPX(name)
+    if test.valid && err != nil {
+      t.Errorf("test %d: unexpected error: %v", i, err)
+    } else if !test.valid && err == nil {
+      t.Errorf("test %d: expected an error; actual: %v", i, paths)
+    } else if !slices.EqualFunc(paths, test.expected, slices.Equal) {
+      t.Errorf("test %d: expected: %v; actual: %v", i, test.expected, paths)
+    }
+  }
+}
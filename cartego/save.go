@@ -0,0 +1,151 @@
+package main
+
+import (
+  "cartego"
+  "cmp"
+  "fmt"
+  "io"
+  "os"
+  "path"
+  "slices"
+  "sync"
+  "time"
+)
+
+// at most this many failed tiles are listed at the end of a download
+const maxListedFailures = 20
+
+// a tileFailure is a tile that couldn't be downloaded or saved
+type tileFailure struct {
+  Tile cartego.Tile
+  Err error
+}
+
+type saveJob struct {
+  fname string
+  image *cartego.Image
+}
+
+// A saver writes tiles to disk with a fixed number of writers. Queueing a
+// tile blocks while they're all busy, which in turn holds up the download,
+// so a slow disk can't make tiles pile up in memory. Every tile queued or
+// failed ends up either saved or in the failures.
+type saver struct {
+  jobs chan saveJob
+  wg sync.WaitGroup
+
+  // manifest, if set, records the tiles from its Record
+  manifest *cartego.Manifest
+
+  mu sync.Mutex
+  failures []tileFailure
+}
+
+func newSaver(writers int) *saver {
+  s := &saver{jobs: make(chan saveJob)}
+  for i := 0; i < max(writers, 1); i++ {
+    s.wg.Add(1)
+    go s.work()
+  }
+  return s
+}
+
+func (s *saver) work() {
+  defer s.wg.Done()
+  for job := range s.jobs {
+    err := save(job.fname, job.image)
+    // the manifest records the tile when it is closed, so it only lists
+    // tiles that made it to disk
+    if err != nil && s.manifest != nil {
+      s.manifest.Drop(job.image)
+    }
+    job.image.Close()
+
+    if err != nil {
+      s.fail(job.image.Tile, err)
+    } else {
+      jobJournal.Record(job.image.Tile, tileDone)
+    }
+  }
+}
+
+// save queues image to be written to fname, relative to downloadDir
+func (s *saver) save(fname string, image *cartego.Image) {
+  s.jobs<-saveJob{fname, image}
+}
+
+// fail records that t couldn't be downloaded or saved
+func (s *saver) fail(t cartego.Tile, err error) {
+  fmt.Fprintf(os.Stderr, "\rError with tile %d/%d/%d: %v\n", t.Zoom, t.X, t.Y, err)
+  jobJournal.Record(t, tileFailed)
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.failures = append(s.failures, tileFailure{t, err})
+}
+
+// wait waits for the queued tiles to be written and returns the tiles that
+// failed, ordered by zoom level and position. No tiles can be queued after.
+func (s *saver) wait() []tileFailure {
+  close(s.jobs)
+  s.wg.Wait()
+
+  slices.SortFunc(s.failures, func(a, b tileFailure) int {
+    return cmp.Or(cmp.Compare(a.Tile.Zoom, b.Tile.Zoom), cmp.Compare(a.Tile.X, b.Tile.X), cmp.Compare(a.Tile.Y, b.Tile.Y))
+  })
+  return s.failures
+}
+
+// save writes image to fname, relative to downloadDir, leaving it for the
+// caller to close
+func save(fname string, image *cartego.Image) error {
+  fpath := path.Join(downloadDir, fname)
+  err := os.MkdirAll(path.Dir(fpath), os.ModeDir | os.ModePerm)
+  if err != nil {
+    return fmt.Errorf("creating tile directory: %w", err)
+  }
+
+  // write next to the tile and move it into place once complete, so a
+  // failed refresh leaves the cached tile alone; the leading dot keeps
+  // loadCacheFlat from mistaking it for a tile
+  f, err := os.CreateTemp(path.Dir(fpath), "."+path.Base(fpath)+".*.tmp")
+  if err != nil {
+    return fmt.Errorf("creating tile file: %w", err)
+  }
+
+  _, err = io.Copy(f, image.Buf)
+  if err == nil {
+    err = f.Chmod(0644)
+  }
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Rename(f.Name(), fpath)
+  }
+  if err != nil {
+    os.Remove(f.Name())
+    return fmt.Errorf("writing tile file: %w", err)
+  }
+
+  // a refreshed tile may have come back in a different format
+  if old := tileMetadata.Get(image.Tile); old != nil && old.File != fname {
+    os.Remove(path.Join(downloadDir, old.File))
+  }
+  tileMetadata.Set(image.Tile, &tileMeta{File: fname, CacheInfo: image.Cache, Fetched: time.Now()})
+  return nil
+}
+
+func printFailures(failures []tileFailure) {
+  if len(failures) == 0 {
+    return
+  }
+
+  fmt.Fprintf(os.Stderr, "%d tiles failed:\n", len(failures))
+  for _, f := range failures[:min(len(failures), maxListedFailures)] {
+    fmt.Fprintf(os.Stderr, "  %d/%d/%d: %v\n", f.Tile.Zoom, f.Tile.X, f.Tile.Y, f.Err)
+  }
+  if len(failures) > maxListedFailures {
+    fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(failures) - maxListedFailures)
+  }
+}
@@ -1,13 +1,19 @@
 package cartego
 
 import (
+  "iter"
   "math"
+  "slices"
 )
 
 // Radius of the earth in meters
 const R = 6378100
 const TILESIZE = 256
 
+// MaxLat is the latitude in degrees where Web Mercator tiles end, north and
+// south.
+const MaxLat = 85.0511287798066
+
 type Point struct {
   Lat, Lon float64
 }
@@ -64,7 +70,48 @@ func translate(lat, lon, d, bearing float64) Point {
   return Point{toDeg(lat2), toDeg(lon2)}
 }
 
-func GetTileCoords(lat, lon, radius float64, minZoom, maxZoom int) (ret []Tile) {
+// distance returns the great-circle distance in meters between a and b
+func distance(a, b Point) float64 {
+  lat1, lat2 := toRad(a.Lat), toRad(b.Lat)
+  dLat, dLon := lat2 - lat1, toRad(b.Lon - a.Lon)
+
+  h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1) * math.Cos(lat2) * math.Pow(math.Sin(dLon/2), 2)
+  return 2 * R * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// tileBounds returns the latitudes and longitudes of the edges of t
+func tileBounds(t Tile) (south, west, north, east float64) {
+  n := float64(int(1) << uint(t.Zoom))
+  lat := func(y int) float64 {
+    return toDeg(math.Atan(math.Sinh(math.Pi * (1 - 2 * float64(y) / n))))
+  }
+  return lat(t.Y+1), float64(t.X) / n * 360 - 180, lat(t.Y), float64(t.X+1) / n * 360 - 180
+}
+
+// nearest returns the point of t's footprint closest to p, on the sphere.
+// Beside t, that is on its nearer west or east edge, but not at p's latitude:
+// a meridian comes closest to p nearer the pole, by more the further away it
+// is, so for large tiles at high latitudes the closest point can be well
+// along the edge from the corner.
+func nearest(t Tile, p Point) Point {
+  south, west, north, east := tileBounds(t)
+
+  // measure from the side of the antimeridian t is on
+  lon := p.Lon - 360 * math.Round((p.Lon - (west + east) / 2) / 360)
+  edge := max(min(lon, east), west)
+
+  lat := p.Lat
+  if edge != lon {
+    // where the great circle along the edge comes closest to p
+    phi, dLon := toRad(p.Lat), toRad(lon - edge)
+    lat = toDeg(math.Atan2(math.Sin(phi), math.Cos(phi) * math.Cos(dLon)))
+  }
+  return Point{max(min(lat, north), south), edge}
+}
+
+// circleRects returns the tiles covering the square around the circle at
+// each zoom level. Where the square crosses the antimeridian, X0 > X1.
+func circleRects(lat, lon, radius float64, minZoom, maxZoom int) (ret []tileRect) {
   north := translate(lat, lon, radius, 0)
   south := translate(lat, lon, radius, 180)
   west := translate(lat, lon, radius, 270)
@@ -76,12 +123,98 @@ func GetTileCoords(lat, lon, radius float64, minZoom, maxZoom int) (ret []Tile)
     x0 := getMercatorFromGPS(west, zoom)
     x1 := getMercatorFromGPS(east, zoom)
 
-    for i := x0.X; i <= x1.X; i++ {
-      for j := y0.Y; j <= y1.Y; j++ {
-        ret = append(ret, Tile{X: i, Y: j, Zoom: zoom})
-      }
+    ret = append(ret, tileRect{zoom, x0.X, y0.Y, x1.X, y1.Y})
+  }
+
+  return ret
+}
+
+// bboxRects returns the tiles covering the box at each zoom level. Latitudes
+// beyond MaxLat are clamped to it. A box whose west edge is east of its east
+// edge crosses the antimeridian, and its rects go past the east edge of the
+// map.
+func bboxRects(south, west, north, east float64, minZoom, maxZoom int) (ret []tileRect) {
+  south = max(min(south, MaxLat), -MaxLat)
+  north = max(min(north, MaxLat), -MaxLat)
+  if south > north {
+    return nil
+  }
+
+  for zoom := minZoom; zoom <= maxZoom; zoom++ {
+    n := 1 << uint(zoom)
+    nw := getMercatorFromGPS(Point{north, west}, zoom)
+    se := getMercatorFromGPS(Point{south, east}, zoom)
+
+    // the edges of the map fall on the edge of a tile, which is the tile
+    // past them, or for the east edge the first tile again
+    if east >= 180 {
+      se.X = n - 1
     }
+    if west > east {
+      se.X += n
+    }
+    nw.Y = max(nw.Y, 0)
+    se.Y = min(se.Y, n - 1)
+
+    ret = append(ret, tileRect{zoom, nw.X, nw.Y, se.X, se.Y})
   }
 
   return ret
 }
+
+// walkRects yields the tiles of each rect in turn, in order o
+func walkRects(rects []tileRect, o Order) iter.Seq[Tile] {
+  return func(yield func(Tile) bool) {
+    for _, r := range rects {
+      if r.Y0 > r.Y1 {
+        continue
+      }
+      if !o.walk(r, yield) {
+        return
+      }
+    }
+  }
+}
+
+// TileCoords yields the same tiles as GetTileCoords, one zoom level after the
+// other in order o, without building a slice of them.
+func TileCoords(lat, lon, radius float64, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  return walkRects(circleRects(lat, lon, radius, minZoom, maxZoom), o)
+}
+
+func GetTileCoords(lat, lon, radius float64, minZoom, maxZoom int) []Tile {
+  return slices.Collect(TileCoords(lat, lon, radius, minZoom, maxZoom, ZoomOrder))
+}
+
+// TileCoordsCircle yields the same tiles as GetTileCoordsCircle, one zoom
+// level after the other in order o, without building a slice of them.
+func TileCoordsCircle(lat, lon, radius float64, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  center := Point{lat, lon}
+  return func(yield func(Tile) bool) {
+    for t := range TileCoords(lat, lon, radius, minZoom, maxZoom, o) {
+      if distance(center, nearest(t, center)) <= radius && !yield(t) {
+        return
+      }
+    }
+  }
+}
+
+// GetTileCoordsCircle is like GetTileCoords, but leaves out the tiles in the
+// corners of the square around the circle: it only returns the tiles with
+// some part within radius meters of the center.
+func GetTileCoordsCircle(lat, lon, radius float64, minZoom, maxZoom int) []Tile {
+  return slices.Collect(TileCoordsCircle(lat, lon, radius, minZoom, maxZoom, ZoomOrder))
+}
+
+// TileCoordsBBox yields the same tiles as GetTileCoordsBBox, one zoom level
+// after the other in order o, without building a slice of them.
+func TileCoordsBBox(south, west, north, east float64, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  return walkRects(bboxRects(south, west, north, east, minZoom, maxZoom), o)
+}
+
+// GetTileCoordsBBox returns the tiles covering the box between the given
+// latitudes and longitudes, in decimal degrees, at each zoom level from
+// minZoom to maxZoom.
+func GetTileCoordsBBox(south, west, north, east float64, minZoom, maxZoom int) []Tile {
+  return slices.Collect(TileCoordsBBox(south, west, north, east, minZoom, maxZoom, ZoomOrder))
+}
@@ -2,6 +2,7 @@ package cartego
 
 import (
   "math"
+  "slices"
   "sort"
   "testing"
 )
@@ -206,7 +207,237 @@ func TestGetTileCoords(t *testing.T) {
   for _, test := range tests {
     tiles := GetTileCoords(test.lat, test.lon, test.radius, test.minZoom, test.maxZoom)
     if !test.passes(tiles) {
-      t.Errorf("given: %f,%f,%f,%d,%d; expected: %#v; actual: %#v", test.lat, test.lon, test.radius, test.minZoom, test.maxZoom)
+      t.Errorf("given: %f,%f,%f,%d,%d; expected: %#v; actual: %#v", test.lat, test.lon, test.radius, test.minZoom, test.maxZoom, test.expected, tiles)
+    }
+  }
+}
+
+type bboxTest struct {
+  south, west, north, east float64
+  minZoom, maxZoom int
+  expected []Tile
+}
+
+func TestGetTileCoordsBBox(t *testing.T) {
+  tests := []bboxTest{
+    // around the same point as TestGetTileCoords
+    bboxTest{40.3061, -111.655, 40.3062, -111.6549, 17, 18, []Tile{
+        Tile{X: 24883, Y: 49475, Zoom: 17},
+        Tile{X: 49767, Y: 98950, Zoom: 18},
+      },
+    },
+    // the whole world, past the poles
+    bboxTest{-90, -180, 90, 180, 1, 1, []Tile{
+        Tile{X: 0, Y: 0, Zoom: 1},
+        Tile{X: 0, Y: 1, Zoom: 1},
+        Tile{X: 1, Y: 0, Zoom: 1},
+        Tile{X: 1, Y: 1, Zoom: 1},
+      },
+    },
+    // the north-east quarter of the world
+    bboxTest{1, 1, 80, 180, 2, 2, []Tile{
+        Tile{X: 2, Y: 0, Zoom: 2},
+        Tile{X: 2, Y: 1, Zoom: 2},
+        Tile{X: 3, Y: 0, Zoom: 2},
+        Tile{X: 3, Y: 1, Zoom: 2},
+      },
+    },
+    // south of north
+    bboxTest{41, -112, 40, -111, 10, 10, nil},
+  }
+
+  for _, test := range tests {
+    tiles := GetTileCoordsBBox(test.south, test.west, test.north, test.east, test.minZoom, test.maxZoom)
+    if !(getTilesTest{expected: test.expected}).passes(tiles) {
+      t.Errorf("given: %f,%f,%f,%f,%d,%d; expected: %#v; actual: %#v", test.south, test.west, test.north, test.east, test.minZoom, test.maxZoom, test.expected, tiles)
+    }
+  }
+
+  n := len(GetTileCoordsBBox(-90, -180, 90, 180, 0, 4))
+  if n != 1+4+16+64+256 {
+    t.Errorf("expected every tile of the world; actual: %d tiles", n)
+  }
+}
+
+func TestGetTileCoordsCircle(t *testing.T) {
+  lat, lon, radius := 40.306107, -111.654995, 2000.0
+  square := GetTileCoords(lat, lon, radius, 17, 17)
+  circle := GetTileCoordsCircle(lat, lon, radius, 17, 17)
+
+  // about pi/4 of the square
+  ratio := float64(len(circle)) / float64(len(square))
+  if ratio < .75 || ratio > .85 {
+    t.Errorf("expected about %.0f%% of the %d tiles in the square; actual: %d tiles", 100*math.Pi/4, len(square), len(circle))
+  }
+
+  kept := make(map[Tile]bool)
+  for _, tile := range circle {
+    kept[tile] = true
+  }
+
+  center := Point{lat, lon}
+  if tile := getMercatorFromGPS(center, 17); !kept[tile] {
+    t.Errorf("expected the tile at the center, %v", tile)
+  }
+  for _, bearing := range []float64{0, 90, 180, 270} {
+    p := translate(lat, lon, radius - 10, bearing)
+    if tile := getMercatorFromGPS(p, 17); !kept[tile] {
+      t.Errorf("expected the tile at %v, %v", p, tile)
+    }
+  }
+  for _, bearing := range []float64{45, 135, 225, 315} {
+    p := translate(lat, lon, radius * 1.3, bearing)
+    if tile := getMercatorFromGPS(p, 17); kept[tile] {
+      t.Errorf("unexpected tile at %v, %v", p, tile)
+    }
+  }
+
+  // a tile left out can't have a corner in the circle
+  for _, tile := range square {
+    if kept[tile] {
+      continue
+    }
+    south, west, north, east := tileBounds(tile)
+    for _, c := range []Point{{south, west}, {south, east}, {north, west}, {north, east}} {
+      if distance(center, c) <= radius {
+        t.Errorf("tile %v was left out, but its corner %v is in the circle", tile, c)
+      }
+    }
+  }
+}
+
+// edgeDistance is a slow reference for the distance from p to the closest
+// point of tile's footprint, sampling along its edges
+func edgeDistance(tile Tile, p Point) float64 {
+  south, west, north, east := tileBounds(tile)
+  if p.Lat >= south && p.Lat <= north && p.Lon >= west && p.Lon <= east {
+    return 0
+  }
+
+  d := math.Inf(1)
+  for i := 0; i <= 2000; i++ {
+    f := float64(i) / 2000
+    lat, lon := south + f * (north - south), west + f * (east - west)
+    for _, q := range []Point{{lat, west}, {lat, east}, {south, lon}, {north, lon}} {
+      d = math.Min(d, distance(p, q))
+    }
+  }
+  return d
+}
+
+func TestNearest(t *testing.T) {
+  // large tiles at high latitudes, where the closest point of a tile beside
+  // p is part way along its edge rather than at a corner
+  points := []Point{{75, 10}, {68.5, -150.3}, {-80, 100}, {62, 0.5}, {40, -120}}
+  for _, p := range points {
+    for zoom := 2; zoom <= 5; zoom++ {
+      for _, tile := range GetTileCoords(p.Lat, p.Lon, 1500000, zoom, zoom) {
+        q := nearest(tile, p)
+        south, west, north, east := tileBounds(tile)
+        if q.Lat < south || q.Lat > north || q.Lon < west || q.Lon > east {
+          t.Errorf("%v, tile %v: %v is off the tile", p, tile, q)
+        }
+        if expected, actual := edgeDistance(tile, p), distance(p, q); actual > expected + 10 {
+          t.Errorf("%v, tile %v: expected %.0fm to the tile; actual: %.0fm", p, tile, expected, actual)
+        }
+      }
+    }
+  }
+
+  // so every tile with some part in the circle is kept
+  center := Point{75, 10}
+  kept := make(map[Tile]bool)
+  for _, tile := range GetTileCoordsCircle(center.Lat, center.Lon, 600000, 4, 4) {
+    kept[tile] = true
+  }
+  for _, tile := range GetTileCoords(center.Lat, center.Lon, 1200000, 4, 4) {
+    if d := edgeDistance(tile, center); d < 590000 && !kept[tile] {
+      t.Errorf("tile %v is %.0fm from the center, but was left out", tile, d)
+    }
+  }
+}
+
+// TestAntimeridian checks that areas crossing the antimeridian give the same
+// tiles as the same areas half way around the world, shifted back
+func TestAntimeridian(t *testing.T) {
+  half := func(lon float64) float64 {
+    if lon > 0 {
+      return lon - 180
+    }
+    return lon + 180
+  }
+  shift := func(p Point) Point {
+    return Point{p.Lat, half(p.Lon)}
+  }
+
+  route := []Point{{-17.71, 179.93}, {-17.62, -179.96}, {-17.55, -179.91}}
+  island := Polygon{
+    {{-17.91, 179.81}, {-17.93, -179.87}, {-17.52, -179.84}, {-17.49, 179.86}},
+    {{-17.81, 179.97}, {-17.79, -179.97}, {-17.72, -179.98}},
+  }
+  var shiftedRoute []Point
+  for _, p := range route {
+    shiftedRoute = append(shiftedRoute, shift(p))
+  }
+  var shiftedIsland Polygon
+  for _, ring := range island {
+    var r []Point
+    for _, p := range ring {
+      r = append(r, shift(p))
+    }
+    shiftedIsland = append(shiftedIsland, r)
+  }
+
+  tests := []struct {
+    name string
+    crossing, shifted []Tile
+  }{
+    {"square",
+      GetTileCoords(-17.7, 179.99, 5000, 8, 13),
+      GetTileCoords(-17.7, half(179.99), 5000, 8, 13)},
+    {"circle",
+      GetTileCoordsCircle(-17.7, -179.98, 5000, 8, 13),
+      GetTileCoordsCircle(-17.7, half(-179.98), 5000, 8, 13)},
+    {"bbox",
+      GetTileCoordsBBox(-18.2, 178.6, -17.1, -179.2, 8, 13),
+      GetTileCoordsBBox(-18.2, half(178.6), -17.1, half(-179.2), 8, 13)},
+    {"polygon",
+      GetTileCoordsPolygon([]Polygon{island}, 8, 13),
+      GetTileCoordsPolygon([]Polygon{shiftedIsland}, 8, 13)},
+    {"corridor",
+      GetTileCoordsCorridor([][]Point{route}, 2000, 8, 13),
+      GetTileCoordsCorridor([][]Point{shiftedRoute}, 2000, 8, 13)},
+  }
+
+  for _, test := range tests {
+    got := make(map[Tile]bool)
+    for _, tile := range test.crossing {
+      n := 1 << uint(tile.Zoom)
+      if tile.X < 0 || tile.X >= n {
+        t.Errorf("%s: tile %v is off the map", test.name, tile)
+      }
+      if got[tile] {
+        t.Errorf("%s: tile %v given twice", test.name, tile)
+      }
+      got[tile] = true
+    }
+
+    expected := make([]Tile, len(test.shifted))
+    for i, tile := range test.shifted {
+      n := 1 << uint(tile.Zoom)
+      expected[i] = Tile{X: (tile.X + n/2) % n, Y: tile.Y, Zoom: tile.Zoom}
+    }
+    if len(test.crossing) == 0 || !(getTilesTest{expected: expected}).passes(test.crossing) {
+      t.Errorf("%s: expected: %v; actual: %v", test.name, expected, test.crossing)
+    }
+  }
+
+  // the other orders walk the wrapped rects just the same
+  square := GetTileCoords(-17.7, 179.99, 5000, 8, 13)
+  for _, o := range []Order{SpiralOrder, HilbertOrder} {
+    tiles := slices.Collect(TileCoords(-17.7, 179.99, 5000, 8, 13, o))
+    if !(getTilesTest{expected: square}).passes(tiles) {
+      t.Errorf("order %d: expected: %v; actual: %v", o, square, tiles)
     }
   }
 }
@@ -0,0 +1,68 @@
+package cartego
+
+import (
+  "iter"
+  "math"
+  "slices"
+)
+
+// corners of the polygons rounding off the ends and joins of a corridor
+const capSides = 16
+
+// bearing returns the initial bearing in degrees from a to b
+func bearing(a, b Point) float64 {
+  lat1, lat2 := toRad(a.Lat), toRad(b.Lat)
+  dLon := toRad(b.Lon - a.Lon)
+
+  y := math.Sin(dLon) * math.Cos(lat2)
+  x := math.Cos(lat1) * math.Sin(lat2) - math.Sin(lat1) * math.Cos(lat2) * math.Cos(dLon)
+  return toDeg(math.Atan2(y, x))
+}
+
+// corridorPolygons returns polygons that together cover everything within
+// buffer meters of path: a rectangle along each segment and a polygon around
+// each point, which is just big enough to hold the circle of the buffer
+func corridorPolygons(path []Point, buffer float64) (ret []Polygon) {
+  outer := buffer / math.Cos(math.Pi / capSides)
+
+  for i, p := range path {
+    ring := make([]Point, capSides)
+    for k := range ring {
+      ring[k] = translate(p.Lat, p.Lon, outer, float64(k) * 360 / capSides)
+    }
+    ret = append(ret, Polygon{ring})
+
+    if i == 0 || path[i-1] == p {
+      continue
+    }
+
+    a, b := path[i-1], p
+    forward, back := bearing(a, b), bearing(b, a)
+    ret = append(ret, Polygon{{
+      translate(a.Lat, a.Lon, buffer, forward - 90),
+      translate(a.Lat, a.Lon, buffer, forward + 90),
+      translate(b.Lat, b.Lon, buffer, back - 90),
+      translate(b.Lat, b.Lon, buffer, back + 90),
+    }})
+  }
+
+  return ret
+}
+
+// TileCoordsCorridor yields the same tiles as GetTileCoordsCorridor, one zoom
+// level after the other in order o, without building a slice of them.
+func TileCoordsCorridor(paths [][]Point, buffer float64, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  var polygons []Polygon
+  for _, path := range paths {
+    polygons = append(polygons, corridorPolygons(path, buffer)...)
+  }
+  return walkCoverage(projectPolygons(polygons), minZoom, maxZoom, o)
+}
+
+// GetTileCoordsCorridor returns the tiles within buffer meters of the routes
+// along paths at each zoom level from minZoom to maxZoom. Each path is a
+// polyline, e.g. a track of a GPX file. Tiles near more than one path, or
+// more than one part of a path, are only returned once.
+func GetTileCoordsCorridor(paths [][]Point, buffer float64, minZoom, maxZoom int) []Tile {
+  return slices.Collect(TileCoordsCorridor(paths, buffer, minZoom, maxZoom, ZoomOrder))
+}
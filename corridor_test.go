@@ -0,0 +1,62 @@
+package cartego
+
+import (
+  "testing"
+)
+
+func TestGetTileCoordsCorridor(t *testing.T) {
+  // a single point is a circle, inside the square GetTileCoords covers, give
+  // or take the corners of the polygon around it
+  point := GetTileCoordsCorridor([][]Point{{{40.306107, -111.654995}}}, 1000, 12, 15)
+  square := make(map[Tile]bool)
+  for _, tile := range GetTileCoords(40.306107, -111.654995, 1030, 12, 15) {
+    square[tile] = true
+  }
+  for _, tile := range point {
+    if !square[tile] {
+      t.Errorf("point: tile %v is outside the square around the circle", tile)
+    }
+  }
+  if len(point) == 0 || len(point) == len(square) {
+    t.Errorf("point: expected fewer than the %d tiles of the square; actual: %d", len(square), len(point))
+  }
+
+  // east, then north
+  path := []Point{{40.0, -111.9}, {40.0, -111.5}, {40.4, -111.5}}
+  for zoom := 13; zoom <= 15; zoom++ {
+    tiles := make(map[Tile]bool)
+    // the second path doubles back over the first
+    back := []Point{{40.2, -111.5}, {40.0, -111.5}, {40.0, -111.6}}
+    for _, tile := range GetTileCoordsCorridor([][]Point{path, back}, 500, zoom, zoom) {
+      if tiles[tile] {
+        t.Errorf("zoom %d: tile %v given twice", zoom, tile)
+      }
+      tiles[tile] = true
+    }
+
+    covered := []Point{
+      path[0], path[1], path[2],
+      {40.0, -111.7},
+      translate(40.0, -111.7, 450, 0),
+      translate(40.0, -111.7, 450, 180),
+      translate(40.2, -111.5, 450, 270),
+      translate(40.0, -111.9, 450, 270),
+    }
+    for _, p := range covered {
+      if tile := getMercatorFromGPS(p, zoom); !tiles[tile] {
+        t.Errorf("zoom %d: expected tile %v around %v", zoom, tile, p)
+      }
+    }
+
+    outside := []Point{
+      {40.4, -111.9},
+      translate(40.0, -111.7, 5000, 0),
+      translate(40.2, -111.5, 5000, 90),
+    }
+    for _, p := range outside {
+      if tile := getMercatorFromGPS(p, zoom); tiles[tile] {
+        t.Errorf("zoom %d: unexpected tile %v around %v", zoom, tile, p)
+      }
+    }
+  }
+}
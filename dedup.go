@@ -0,0 +1,115 @@
+package cartego
+
+import (
+  "bytes"
+  "context"
+  "io"
+  "reflect"
+  "sync"
+)
+
+// flightKey identifies requests that would fetch the same thing. Other
+// Downloaders may send other headers or credentials, or use another client,
+// so only requests from the same one are shared.
+type flightKey struct {
+  d *Downloader
+  strategy Strategy
+  tile Tile
+}
+
+// a flight is a fetch in progress that other callers can wait for
+type flight struct {
+  done chan struct{}
+  waiters int
+
+  // set once done is closed
+  image Image
+  body []byte
+  cancelled bool
+}
+
+// fetches in flight, of every Downloader in the process
+var flights = struct {
+  sync.Mutex
+  m map[flightKey]*flight
+}{m: make(map[flightKey]*flight)}
+
+// hashable reports whether strategy can be used as a map key
+func hashable(strategy Strategy) bool {
+  return strategy != nil && reflect.TypeOf(strategy).Comparable()
+}
+
+// fetchShared is like fetch, but concurrent requests from d for the same tile
+// from the same strategy share a single upstream request. The response is only
+// buffered if somebody joined while it was in flight; each caller then gets
+// its own reader over the body.
+func (d *Downloader) fetchShared(ctx context.Context, strategy Strategy, path string, tile Tile) *Image {
+  var info *CacheInfo
+  if d.CacheLookup != nil {
+    info = d.CacheLookup(tile)
+  }
+
+  // conditional requests depend on what the caller has stored
+  if info != nil || !hashable(strategy) {
+    return d.fetch(ctx, strategy, path, tile, info)
+  }
+
+  key := flightKey{d, strategy, tile}
+  flights.Lock()
+  if f, ok := flights.m[key]; ok {
+    f.waiters++
+    flights.Unlock()
+
+    select {
+    case <-f.done:
+    case <-ctx.Done():
+      return &Image{Err: ctx.Err(), Tile: tile}
+    }
+
+    // whoever made the request gave up on it, but we haven't
+    if f.cancelled && ctx.Err() == nil {
+      return d.fetch(ctx, strategy, path, tile, nil)
+    }
+    return f.share()
+  }
+
+  f := &flight{done: make(chan struct{})}
+  flights.m[key] = f
+  flights.Unlock()
+
+  image := d.fetch(ctx, strategy, path, tile, nil)
+
+  // nobody can join once we're out of the map
+  flights.Lock()
+  delete(flights.m, key)
+  shared := f.waiters > 0
+  flights.Unlock()
+
+  defer close(f.done)
+  f.cancelled = ctx.Err() != nil
+  if !shared {
+    return image
+  }
+
+  f.image = *image
+  f.image.Buf = nil
+  if image.Buf != nil {
+    // a body kept for an error response still leaves the error in place
+    body, err := io.ReadAll(image.Buf)
+    image.Buf.Close()
+    f.body = body
+    if err != nil {
+      f.image.Err = err
+    }
+  }
+  return f.share()
+}
+
+// share makes a copy of the result with its own reader over the body
+func (f *flight) share() *Image {
+  image := f.image
+  if f.body != nil {
+    image.Buf = io.NopCloser(bytes.NewReader(f.body))
+  }
+  return &image
+}
@@ -0,0 +1,526 @@
+package cartego
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+type testStrategy struct {
+  base string
+}
+
+func (s testStrategy) GetPath(t Tile, _ int) string {
+  return fmt.Sprintf("%s/%d/%d/%d", s.base, t.Zoom, t.X, t.Y)
+}
+
+func testTiles(n int) (ret []Tile) {
+  for i := 0; i < n; i++ {
+    ret = append(ret, Tile{X: i, Y: i, Zoom: 10})
+  }
+  return ret
+}
+
+func TestDownloaderInstances(t *testing.T) {
+  a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "image/png")
+    io.WriteString(w, "a")
+  }))
+  defer a.Close()
+  b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "image/jpeg")
+    io.WriteString(w, "b")
+  }))
+  defer b.Close()
+
+  da := &Downloader{Strategy: testStrategy{a.URL}, Concurrency: 2}
+  db := &Downloader{Strategy: testStrategy{b.URL}, Concurrency: 3}
+
+  ca := da.Download(testTiles(5))
+  cb := db.Download(testTiles(7))
+
+  for _, test := range []struct {
+    c <-chan *Image
+    n int
+    body string
+  }{{ca, 5, "a"}, {cb, 7, "b"}} {
+    n := 0
+    for image := range test.c {
+      if image.Err != nil {
+        t.Fatalf("unexpected error: %v", image.Err)
+      }
+      buf, _ := io.ReadAll(image.Buf)
+      if string(buf) != test.body {
+        t.Errorf("expected: %q; actual: %q", test.body, buf)
+      }
+      n++
+    }
+    if n != test.n {
+      t.Errorf("expected %d images; actual: %d", test.n, n)
+    }
+  }
+}
+
+func TestDownloadContext(t *testing.T) {
+  var hits int32
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&hits, 1)
+  }))
+  defer s.Close()
+
+  // nothing is started for a context that's already done
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  for image := range DownloadContext(ctx, testTiles(5), testStrategy{s.URL}) {
+    if image.Err == nil {
+      t.Errorf("expected an error for tile %#v", image.Tile)
+    }
+  }
+  if n := atomic.LoadInt32(&hits); n != 0 {
+    t.Errorf("expected no requests; actual: %d", n)
+  }
+
+  n := 0
+  for image := range DownloadContext(context.Background(), testTiles(5), testStrategy{s.URL}) {
+    if image.Err != nil {
+      t.Errorf("unexpected error: %v", image.Err)
+    }
+    image.Close()
+    n++
+  }
+  if n != 5 {
+    t.Errorf("expected 5 images; actual: %d", n)
+  }
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+  block := make(chan bool)
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-block:
+    case <-r.Context().Done():
+    }
+  }))
+  defer s.Close()
+  defer close(block)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 2}
+  c := d.DownloadContext(ctx, testTiles(10))
+
+  time.AfterFunc(50*time.Millisecond, cancel)
+
+  n := 0
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case image, ok := <-c:
+      if !ok {
+        if n != 2 {
+          t.Errorf("expected 2 aborted images; actual: %d", n)
+        }
+        return
+      }
+      if image.Err == nil {
+        t.Errorf("expected an error for tile %#v", image.Tile)
+      }
+      n++
+    case <-timeout:
+      t.Fatal("channel was not closed after cancel")
+    }
+  }
+}
+
+func TestDownloaderSlidingWindow(t *testing.T) {
+  n := 6
+  served := make(chan bool, n)
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    // the first tile only finishes once all of the others have
+    if r.URL.Path == "/10/0/0" {
+      for i := 1; i < n; i++ {
+        <-served
+      }
+    } else {
+      served <- true
+    }
+  }))
+  defer s.Close()
+
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 2}
+  c := d.Download(testTiles(n))
+
+  var finished []int
+  timeout := time.After(5 * time.Second)
+  for len(finished) < n {
+    select {
+    case image := <-c:
+      finished = append(finished, image.Tile.X)
+    case <-timeout:
+      t.Fatalf("slow tile stalled the other slots; finished: %v", finished)
+    }
+  }
+}
+
+func TestDownloaderRetries(t *testing.T) {
+  var hits int64
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    switch atomic.AddInt64(&hits, 1) {
+    case 1:
+      w.WriteHeader(http.StatusServiceUnavailable)
+    case 2:
+      w.Header().Set("Retry-After", "0")
+      w.WriteHeader(http.StatusTooManyRequests)
+    default:
+      io.WriteString(w, "tile")
+    }
+  }))
+  defer s.Close()
+
+  d := &Downloader{Strategy: testStrategy{s.URL}, Retries: 3, RetryWait: time.Millisecond}
+  image := <-d.Download(testTiles(1))
+  if image.Err != nil {
+    t.Fatalf("unexpected error: %v", image.Err)
+  }
+  if image.Attempts != 3 {
+    t.Errorf("expected 3 attempts; actual: %d", image.Attempts)
+  }
+}
+
+func TestDownloaderRetryHistory(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  url := s.URL
+  s.Close()
+
+  d := &Downloader{Strategy: testStrategy{url}, Retries: 2, RetryWait: time.Millisecond}
+  image := <-d.Download(testTiles(1))
+
+  var rerr *RetryError
+  if !errors.As(image.Err, &rerr) {
+    t.Fatalf("expected a RetryError; actual: %v", image.Err)
+  }
+  if len(rerr.Errors) != 3 || image.Attempts != 3 {
+    t.Errorf("expected 3 attempts; actual: %d errors, %d attempts", len(rerr.Errors), image.Attempts)
+  }
+}
+
+func TestDownloaderStatusError(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "no such tile", http.StatusNotFound)
+  }))
+  defer s.Close()
+
+  for _, keep := range []bool{false, true} {
+    d := &Downloader{Strategy: testStrategy{s.URL}, KeepErrorBody: keep}
+    image := <-d.Download(testTiles(1))
+
+    var serr *StatusError
+    if !errors.As(image.Err, &serr) || serr.Code != http.StatusNotFound {
+      t.Errorf("expected a 404 StatusError; actual: %v", image.Err)
+    }
+    if image.StatusCode != http.StatusNotFound {
+      t.Errorf("expected status 404; actual: %d", image.StatusCode)
+    }
+    if image.IsZero() == keep {
+      t.Errorf("KeepErrorBody: %v; Buf: %v", keep, image.Buf)
+    }
+  }
+}
+
+func TestDownloaderRevalidate(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "max-age=60")
+    if r.Header.Get("If-None-Match") == `"v1"` {
+      w.WriteHeader(http.StatusNotModified)
+      return
+    }
+    w.Header().Set("ETag", `"v2"`)
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  tiles := testTiles(2)
+  d := &Downloader{Strategy: testStrategy{s.URL}, CacheLookup: func(t Tile) *CacheInfo {
+    if t == tiles[0] {
+      return &CacheInfo{ETag: `"v1"`}
+    }
+    return nil
+  }}
+
+  for image := range d.Download(tiles) {
+    if image.Err != nil {
+      t.Fatalf("unexpected error: %v", image.Err)
+    }
+
+    cached := image.Tile == tiles[0]
+    if image.NotModified != cached {
+      t.Errorf("tile %#v: expected NotModified %v", image.Tile, cached)
+    }
+    if cached && image.Cache.ETag != `"v1"` {
+      t.Errorf("expected the stored ETag to carry over; actual: %q", image.Cache.ETag)
+    }
+    if !cached && image.Cache.ETag != `"v2"` {
+      t.Errorf("expected the new ETag; actual: %q", image.Cache.ETag)
+    }
+    if time.Until(image.Cache.Expires) < 50*time.Second {
+      t.Errorf("expected Expires from max-age; actual: %v", image.Cache.Expires)
+    }
+  }
+}
+
+func TestDownloaderProgress(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/10/0/0" {
+      w.WriteHeader(http.StatusNotFound)
+      return
+    }
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  var reports []Progress
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 2, Progress: func(p Progress) {
+    reports = append(reports, p)
+  }}
+  for image := range d.Download(testTiles(4)) {
+    if image.Err == nil {
+      io.ReadAll(image.Buf)
+    }
+  }
+
+  // one for each tile and one for each body read
+  if len(reports) != 7 {
+    t.Fatalf("expected 7 reports; actual: %d", len(reports))
+  }
+  last := reports[6]
+  if last.Completed != 3 || last.Failed != 1 || last.Remaining != 0 {
+    t.Errorf("expected 3 completed, 1 failed; actual: %#v", last)
+  }
+  if last.Bytes != 12 {
+    t.Errorf("expected all 12 bytes in the last report; actual: %d", last.Bytes)
+  }
+  if last.Rate <= 0 || last.ETA != 0 {
+    t.Errorf("expected a rate and no time left; actual: %#v", last)
+  }
+  if reports[0].Remaining != 3 {
+    t.Errorf("expected 3 remaining after the first tile; actual: %d", reports[0].Remaining)
+  }
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+  return f(r)
+}
+
+func TestDownloaderTransportHeaders(t *testing.T) {
+  var ua, key string
+  d := &Downloader{
+    Strategy: testStrategy{"http://tiles.example.com"},
+    Header: http.Header{"X-Api-Key": []string{"secret"}},
+    UserAgent: "tester/1.0",
+    Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+      ua, key = r.Header.Get("User-Agent"), r.Header.Get("X-Api-Key")
+      return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("tile")), Header: http.Header{}}, nil
+    }),
+  }
+
+  image := <-d.Download(testTiles(1))
+  if image.Err != nil {
+    t.Fatalf("unexpected error: %v", image.Err)
+  }
+  if ua != "tester/1.0" || key != "secret" {
+    t.Errorf("expected headers to be sent; User-Agent: %q, X-Api-Key: %q", ua, key)
+  }
+}
+
+func TestDownloaderTimeout(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    <-r.Context().Done()
+  }))
+  defer s.Close()
+
+  d := &Downloader{Strategy: testStrategy{s.URL}, Timeout: 20 * time.Millisecond}
+  image := <-d.Download(testTiles(1))
+  if !errors.Is(image.Err, context.DeadlineExceeded) {
+    t.Errorf("expected a timeout; actual: %v", image.Err)
+  }
+}
+
+func TestDownloaderTotalTimeoutReleased(t *testing.T) {
+  ctxs := make(chan context.Context, 3)
+  d := &Downloader{
+    Strategy: testStrategy{"http://tiles.example.com"},
+    TotalTimeout: time.Hour,
+    Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+      ctxs<-r.Context()
+      return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("tile")), Header: http.Header{}}, nil
+    }),
+  }
+
+  var images []*Image
+  for image := range d.Download(testTiles(3)) {
+    images = append(images, image)
+  }
+  ctx := <-ctxs
+
+  // the deadline holds while any body is open, and is released after that
+  // rather than an hour later
+  for _, image := range images[1:] {
+    image.Close()
+  }
+  if ctx.Err() != nil {
+    t.Fatalf("released with a body still open: %v", ctx.Err())
+  }
+  images[0].Close()
+
+  select {
+  case <-ctx.Done():
+  case <-time.After(time.Second):
+    t.Error("expected the deadline to be released once every body was closed")
+  }
+}
+
+func TestDownloaderSharesFetches(t *testing.T) {
+  var hits int64
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt64(&hits, 1)
+    time.Sleep(100 * time.Millisecond)
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  strategy := &testStrategy{s.URL}
+  tile := testTiles(1)[0]
+  d := &Downloader{Strategy: strategy, Concurrency: 3}
+
+  // another Downloader could send other credentials, so it doesn't share
+  other := &Downloader{Strategy: strategy, Header: http.Header{"X-Api-Key": []string{"other"}}}
+  cs := []<-chan *Image{d.Download([]Tile{tile, tile, tile}), other.Download([]Tile{tile})}
+
+  for _, c := range cs {
+    for image := range c {
+      if image.Err != nil {
+        t.Fatalf("unexpected error: %v", image.Err)
+      }
+      if buf, _ := io.ReadAll(image.Buf); string(buf) != "tile" {
+        t.Errorf("expected: %q; actual: %q", "tile", buf)
+      }
+      image.Close()
+    }
+  }
+
+  if hits != 2 {
+    t.Errorf("expected a request for each Downloader; actual: %d", hits)
+  }
+}
+
+func TestDownloaderSharesErrorBody(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    time.Sleep(100 * time.Millisecond)
+    w.WriteHeader(http.StatusNotFound)
+    io.WriteString(w, "not found")
+  }))
+  defer s.Close()
+
+  tile := testTiles(1)[0]
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 2, KeepErrorBody: true}
+  n := 0
+  for image := range d.Download([]Tile{tile, tile}) {
+    n++
+    var serr *StatusError
+    if !errors.As(image.Err, &serr) || serr.Code != http.StatusNotFound {
+      t.Errorf("expected a 404 StatusError; actual: %v", image.Err)
+    }
+    if buf, _ := io.ReadAll(image.Buf); string(buf) != "not found" {
+      t.Errorf("expected the error body; actual: %q", buf)
+    }
+    image.Close()
+  }
+  if n != 2 {
+    t.Errorf("expected 2 images; actual: %d", n)
+  }
+}
+
+func TestDownloadBuffersEveryTile(t *testing.T) {
+  var hits int64
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt64(&hits, 1)
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  // nothing is received until every tile has been fetched
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 1}
+  c := d.Download(testTiles(5))
+  for start := time.Now(); atomic.LoadInt64(&hits) < 5; time.Sleep(time.Millisecond) {
+    if time.Since(start) > time.Second {
+      t.Fatalf("downloads waited for the receiver after %d tiles", atomic.LoadInt64(&hits))
+    }
+  }
+
+  for image := range c {
+    image.Close()
+  }
+}
+
+func TestDownloadSeq(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer s.Close()
+
+  var last Progress
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 4, Progress: func(p Progress) {
+    last = p
+  }}
+  tiles := TileCoords(40.306107, -111.654995, 1000, 14, 16, SpiralOrder)
+
+  n := 0
+  for image := range d.DownloadSeq(context.Background(), tiles, -1) {
+    if image.Err != nil {
+      t.Fatalf("unexpected error: %v", image.Err)
+    }
+    n++
+  }
+
+  if expected := len(GetTileCoords(40.306107, -111.654995, 1000, 14, 16)); n != expected {
+    t.Errorf("expected %d images; actual: %d", expected, n)
+  }
+  if last.Remaining != -1 || last.Completed != n {
+    t.Errorf("expected %d completed and an unknown remainder; actual: %#v", n, last)
+  }
+}
+
+func TestDownloaderBuffer(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/10/0/0" {
+      io.WriteString(w, strings.Repeat("x", 100))
+      return
+    }
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  d := &Downloader{Strategy: testStrategy{s.URL}, Buffer: true, MaxBodySize: 50}
+  for image := range d.Download(testTiles(2)) {
+    if image.Tile.X == 0 {
+      if !errors.Is(image.Err, ErrTooLarge) || image.Buf != nil {
+        t.Errorf("expected ErrTooLarge without a body; actual: %v, %v", image.Err, image.Buf)
+      }
+      continue
+    }
+
+    // the body is already in memory, so the server can go away
+    s.CloseClientConnections()
+    buf, err := io.ReadAll(image.Buf)
+    image.Close()
+    if err != nil || string(buf) != "tile" {
+      t.Errorf("expected: %q; actual: %q, %v", "tile", buf, err)
+    }
+  }
+}
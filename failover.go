@@ -0,0 +1,137 @@
+package cartego
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+)
+
+// Failover is a Strategy that tries each of its strategies in turn until one
+// serves the tile. A strategy fails on a network error, a non-2xx response,
+// or, if the Downloader validates tiles, an invalid tile such as a
+// placeholder. Image.Strategy records the strategy that served the tile.
+//
+// Settings made for a Failover, with SetStrategyRateLimit or
+// RegisterPlaceholder, apply to each of its strategies.
+type Failover []Strategy
+
+// GetPath returns the path of the first strategy.
+func (f Failover) GetPath(t Tile, i int) string {
+  if len(f) == 0 {
+    return ""
+  }
+  return f[0].GetPath(t, i)
+}
+
+// Name lists the strategies in order.
+func (f Failover) Name() string {
+  names := make([]string, len(f))
+  for i, s := range f {
+    names[i] = StrategyName(s)
+  }
+  return strings.Join(names, ",")
+}
+
+// A FailoverError is reported when every strategy of a Failover failed.
+// Errors holds the error of each strategy, in order.
+type FailoverError struct {
+  Errors []error
+}
+
+func (e *FailoverError) Error() string {
+  msgs := make([]string, len(e.Errors))
+  for i, err := range e.Errors {
+    msgs[i] = err.Error()
+  }
+  return fmt.Sprintf("all %d strategies failed (%s)", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the last strategy.
+func (e *FailoverError) Unwrap() error {
+  if len(e.Errors) == 0 {
+    return nil
+  }
+  return e.Errors[len(e.Errors)-1]
+}
+
+var errNoStrategies = errors.New("failover without strategies")
+
+// a source is a strategy and the path it gives for a tile
+type source struct {
+  strategy Strategy
+  path string
+}
+
+// strategies may keep state between calls to GetPath (e.g. Google), so
+// those calls are never made concurrently
+var pathMu sync.Mutex
+
+func getPath(strategy Strategy, t Tile, i int) string {
+  pathMu.Lock()
+  defer pathMu.Unlock()
+  return strategy.GetPath(t, i)
+}
+
+// members lists the strategies a request for strategy may be sent with:
+// those of a Failover, or the strategy itself
+func members(strategy Strategy) []Strategy {
+  if f, ok := strategy.(Failover); ok {
+    var ret []Strategy
+    for _, s := range f {
+      ret = append(ret, members(s)...)
+    }
+    return ret
+  }
+  return []Strategy{strategy}
+}
+
+// sources lists where to get t from, in the order to try them
+func sources(strategy Strategy, t Tile, i int) []source {
+  if f, ok := strategy.(Failover); ok {
+    var ret []source
+    for _, s := range f {
+      ret = append(ret, sources(s, t, i)...)
+    }
+    return ret
+  }
+  return []source{{strategy, getPath(strategy, t, i)}}
+}
+
+// get fetches t from the first of srcs that serves it
+func (d *Downloader) get(ctx context.Context, srcs []source, t Tile) *Image {
+  if len(srcs) == 0 {
+    return &Image{Err: errNoStrategies, Tile: t}
+  }
+
+  var image *Image
+  var errs []error
+  for _, src := range srcs {
+    // an error body kept from the previous source is of no use now
+    if image != nil {
+      image.Close()
+    }
+
+    image = d.fetchShared(ctx, src.strategy, src.path, t)
+    if d.Buffer && image.Buf != nil {
+      if _, err := d.readBody(image); err != nil {
+        image.Err = err
+      }
+    }
+    if d.Validate {
+      image = d.validate(ctx, src.strategy, image)
+    }
+    image.Strategy = src.strategy
+
+    if image.Err == nil || ctx.Err() != nil {
+      return image
+    }
+    errs = append(errs, fmt.Errorf("%s: %w", StrategyName(src.strategy), image.Err))
+  }
+
+  if len(errs) > 1 {
+    image.Err = &FailoverError{errs}
+  }
+  return image
+}
@@ -0,0 +1,67 @@
+package cartego
+
+import (
+  "crypto/sha256"
+  "errors"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestFailover(t *testing.T) {
+  down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }))
+  defer down.Close()
+  missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.NotFound(w, r)
+  }))
+  defer missing.Close()
+  up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    io.WriteString(w, "tile")
+  }))
+  defer up.Close()
+
+  primary, secondary := &testStrategy{down.URL}, &testStrategy{up.URL}
+  d := &Downloader{Strategy: Failover{primary, secondary}}
+  image := <-d.Download(testTiles(1))
+  if image.Err != nil {
+    t.Fatalf("unexpected error: %v", image.Err)
+  }
+  if image.Strategy != secondary {
+    t.Errorf("expected the secondary strategy to serve the tile; actual: %v", image.Strategy)
+  }
+
+  d = &Downloader{Strategy: Failover{primary, &testStrategy{missing.URL}}}
+  image = <-d.Download(testTiles(1))
+  var ferr *FailoverError
+  if !errors.As(image.Err, &ferr) || len(ferr.Errors) != 2 {
+    t.Fatalf("expected a FailoverError with 2 errors; actual: %v", image.Err)
+  }
+  var serr *StatusError
+  if !errors.As(image.Err, &serr) || serr.Code != http.StatusNotFound {
+    t.Errorf("expected the last error to be a 404; actual: %v", image.Err)
+  }
+}
+
+func TestFailoverSettings(t *testing.T) {
+  primary, secondary := &testStrategy{"http://primary"}, &testStrategy{"http://secondary"}
+  f := Failover{primary, Failover{secondary}}
+
+  // these used to panic, a slice being no map key
+  SetStrategyRateLimit(f, 10, 1)
+  defer SetStrategyRateLimit(f, 0, 0)
+  sum := sha256.Sum256([]byte("placeholder"))
+  RegisterPlaceholder(f, sum)
+
+  limits.Lock()
+  limited := limits.strategies[primary] != nil && limits.strategies[secondary] != nil
+  limits.Unlock()
+  if !limited {
+    t.Errorf("expected a rate limit for each strategy of the failover")
+  }
+  if !isPlaceholder(primary, []byte("placeholder")) || !isPlaceholder(secondary, []byte("placeholder")) {
+    t.Errorf("expected the placeholder to be registered for each strategy of the failover")
+  }
+}
@@ -0,0 +1,226 @@
+package cartego
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "hash"
+  "io"
+  "sync"
+  "time"
+)
+
+// A ManifestTile records a downloaded tile.
+type ManifestTile struct {
+  Zoom int `json:"z"`
+  X int `json:"x"`
+  Y int `json:"y"`
+  Type string `json:"type"`
+  Size int64 `json:"size"`
+  SHA256 string `json:"sha256"`
+  Fetched time.Time `json:"fetched"`
+
+  // Strategy is set if the tile came from another strategy than the
+  // manifest's, e.g. a fallback of a Failover.
+  Strategy string `json:"strategy,omitempty"`
+}
+
+// A Manifest is a verifiable record of what a download produced. Fill in the
+// fields describing the download, pass the images through Record, and write
+// the result with WriteJSON or WriteNDJSON, or Stream it as it grows.
+type Manifest struct {
+  // Region describes the area downloaded, in whatever form it was given.
+  Region any `json:"region,omitempty"`
+  Strategy string `json:"strategy"`
+  MinZoom int `json:"minZoom"`
+  MaxZoom int `json:"maxZoom"`
+  Created time.Time `json:"created"`
+
+  Tiles []ManifestTile `json:"tiles"`
+
+  mu sync.Mutex
+  stream *json.Encoder
+  err error
+}
+
+// Record passes on the images from c, adding each tile to m when its body is
+// closed after being read to the end. Tiles whose body is closed early,
+// tiles passed to Drop, failed tiles and NotModified tiles aren't recorded.
+func (m *Manifest) Record(c <-chan *Image) <-chan *Image {
+  out := make(chan *Image, cap(c))
+  go func() {
+    for image := range c {
+      if image.Err == nil && image.Buf != nil {
+        image.Buf = &manifestBody{ReadCloser: image.Buf, m: m, image: image, fetched: time.Now(), hash: sha256.New()}
+      }
+      out<-image
+    }
+    close(out)
+  }()
+  return out
+}
+
+// Drop leaves out of m an image passed on by Record, e.g. because it couldn't
+// be stored. It must be called before the image is closed.
+func (m *Manifest) Drop(image *Image) {
+  if b, ok := image.Buf.(*manifestBody); ok && b.m == m {
+    b.dropped = true
+  }
+}
+
+func (m *Manifest) add(t ManifestTile) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if m.stream == nil {
+    m.Tiles = append(m.Tiles, t)
+  } else if err := m.stream.Encode(t); err != nil && m.err == nil {
+    m.err = err
+  }
+}
+
+// header is the manifest without its tiles, as written on the first line of
+// newline-delimited JSON
+func (m *Manifest) header() any {
+  return struct {
+    Region any `json:"region,omitempty"`
+    Strategy string `json:"strategy"`
+    MinZoom int `json:"minZoom"`
+    MaxZoom int `json:"maxZoom"`
+    Created time.Time `json:"created"`
+  }{m.Region, m.Strategy, m.MinZoom, m.MaxZoom, m.Created}
+}
+
+// Stream writes the manifest to w as newline-delimited JSON: the header now,
+// then a line for each tile as it is recorded. Streamed tiles aren't kept in
+// Tiles, so memory use doesn't grow with the download. Err reports any error
+// writing a tile.
+func (m *Manifest) Stream(w io.Writer) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  enc := json.NewEncoder(w)
+  if err := m.encodeLines(enc); err != nil {
+    return err
+  }
+
+  m.Tiles = nil
+  m.stream = enc
+  return nil
+}
+
+// Append streams the tiles recorded from now on to w like Stream, without
+// writing a header, to add them to the end of a manifest already written.
+func (m *Manifest) Append(w io.Writer) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.Tiles = nil
+  m.stream = json.NewEncoder(w)
+}
+
+// ReadManifest reads a manifest written by WriteJSON, WriteNDJSON or Stream.
+// A tile may be listed more than once if it was downloaded again; the last
+// entry for it is the current one.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+  dec := json.NewDecoder(r)
+  m := new(Manifest)
+  if err := dec.Decode(m); err != nil {
+    return nil, err
+  }
+
+  for dec.More() {
+    var t ManifestTile
+    if err := dec.Decode(&t); err != nil {
+      return nil, err
+    }
+    m.Tiles = append(m.Tiles, t)
+  }
+  return m, nil
+}
+
+// Err returns the first error streaming a tile.
+func (m *Manifest) Err() error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return m.err
+}
+
+// WriteJSON writes the manifest to w as a single JSON document.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  return enc.Encode(m)
+}
+
+// WriteNDJSON writes the manifest to w as newline-delimited JSON: the header
+// on the first line, followed by a line for each tile.
+func (m *Manifest) WriteNDJSON(w io.Writer) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return m.encodeLines(json.NewEncoder(w))
+}
+
+// encodeLines writes the header and the tiles so far; the caller holds m.mu
+func (m *Manifest) encodeLines(enc *json.Encoder) error {
+  if err := enc.Encode(m.header()); err != nil {
+    return err
+  }
+  for _, t := range m.Tiles {
+    if err := enc.Encode(t); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// manifestBody hashes a body as it is read and records it when it is closed,
+// once it has been read to the end
+type manifestBody struct {
+  io.ReadCloser
+  m *Manifest
+  image *Image
+  fetched time.Time
+  hash hash.Hash
+  size int64
+
+  tile *ManifestTile
+  dropped bool
+  closed bool
+}
+
+func (b *manifestBody) Read(p []byte) (int, error) {
+  n, err := b.ReadCloser.Read(p)
+  b.hash.Write(p[:n])
+  b.size += int64(n)
+
+  if err == io.EOF && b.tile == nil {
+    b.tile = &ManifestTile{
+      Zoom: b.image.Tile.Zoom,
+      X: b.image.Tile.X,
+      Y: b.image.Tile.Y,
+      Type: b.image.Type,
+      Size: b.size,
+      SHA256: hex.EncodeToString(b.hash.Sum(nil)),
+      Fetched: b.fetched,
+    }
+    if b.image.Strategy != nil {
+      if name := StrategyName(b.image.Strategy); name != b.m.Strategy {
+        b.tile.Strategy = name
+      }
+    }
+  }
+  return n, err
+}
+
+func (b *manifestBody) Close() error {
+  err := b.ReadCloser.Close()
+  if b.tile != nil && !b.dropped && !b.closed {
+    b.m.add(*b.tile)
+  }
+  b.closed = true
+  return err
+}
@@ -0,0 +1,148 @@
+package cartego
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func TestManifest(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "image/png")
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  sum := sha256.Sum256([]byte("tile"))
+  expected := hex.EncodeToString(sum[:])
+
+  for _, stream := range []bool{false, true} {
+    var out bytes.Buffer
+    m := &Manifest{Strategy: "test", MinZoom: 10, MaxZoom: 10}
+    if stream {
+      m.Stream(&out)
+    }
+
+    d := &Downloader{Strategy: testStrategy{s.URL}}
+    for image := range m.Record(d.Download(testTiles(3))) {
+      // a tile that isn't read to the end isn't recorded
+      if image.Tile.X == 2 {
+        image.Close()
+        continue
+      }
+      io.ReadAll(image.Buf)
+      image.Close()
+    }
+
+    var tiles []ManifestTile
+    if stream {
+      lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+      for _, line := range lines[1:] {
+        var tile ManifestTile
+        json.Unmarshal([]byte(line), &tile)
+        tiles = append(tiles, tile)
+      }
+    } else {
+      m.WriteJSON(&out)
+      var decoded Manifest
+      if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+        t.Fatal(err)
+      }
+      tiles = decoded.Tiles
+    }
+
+    if len(tiles) != 2 {
+      t.Fatalf("stream: %v; expected 2 tiles; actual: %#v", stream, tiles)
+    }
+    for _, tile := range tiles {
+      if tile.SHA256 != expected || tile.Size != 4 || tile.Type != "image/png" || tile.Zoom != 10 {
+        t.Errorf("stream: %v; unexpected tile: %#v", stream, tile)
+      }
+    }
+  }
+}
+
+func TestReadManifest(t *testing.T) {
+  tile := func(x int, sum string) ManifestTile {
+    return ManifestTile{Zoom: 3, X: x, Y: 1, Type: "image/png", Size: 4, SHA256: sum}
+  }
+
+  for _, stream := range []bool{false, true} {
+    var out bytes.Buffer
+    m := &Manifest{Strategy: "test", MinZoom: 3, MaxZoom: 3, Tiles: []ManifestTile{tile(0, "a"), tile(1, "b")}}
+    if stream {
+      m.WriteNDJSON(&out)
+    } else {
+      m.WriteJSON(&out)
+    }
+
+    read, err := ReadManifest(&out)
+    if err != nil {
+      t.Fatalf("stream: %v; %v", stream, err)
+    }
+    if read.Strategy != "test" || read.MaxZoom != 3 || len(read.Tiles) != 2 || read.Tiles[1] != tile(1, "b") {
+      t.Errorf("stream: %v; unexpected manifest: %#v", stream, read)
+    }
+  }
+
+  // tiles appended later follow the ones already there
+  var out bytes.Buffer
+  m := &Manifest{Strategy: "test", Tiles: []ManifestTile{tile(0, "a")}}
+  m.WriteNDJSON(&out)
+  m.Append(&out)
+  m.add(tile(0, "c"))
+  m.add(tile(2, "d"))
+
+  read, err := ReadManifest(&out)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := []ManifestTile{tile(0, "a"), tile(0, "c"), tile(2, "d")}
+  if len(read.Tiles) != len(expected) {
+    t.Fatalf("append: expected: %v; actual: %v", expected, read.Tiles)
+  }
+  for i := range expected {
+    if read.Tiles[i] != expected[i] {
+      t.Errorf("append: tile %d; expected: %v; actual: %v", i, expected[i], read.Tiles[i])
+    }
+  }
+
+  if _, err := ReadManifest(strings.NewReader(`{"strategy": "test"}` + "\n" + `{"z": 3, "x"`)); err == nil {
+    t.Error("expected an error for a tile cut off part way")
+  }
+}
+
+func TestManifestDrop(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "image/png")
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  m := &Manifest{Strategy: "test"}
+  d := &Downloader{Strategy: testStrategy{s.URL}}
+  for image := range m.Record(d.Download(testTiles(2))) {
+    n := len(m.Tiles)
+    io.ReadAll(image.Buf)
+    // nothing is recorded until the tile has been stored
+    if len(m.Tiles) != n {
+      t.Errorf("tile %v recorded before its body was closed", image.Tile)
+    }
+
+    // saving the second tile fails
+    if image.Tile.X == 1 {
+      m.Drop(image)
+    }
+    image.Close()
+  }
+
+  if len(m.Tiles) != 1 || m.Tiles[0].X != 0 {
+    t.Errorf("expected only the tile saved; actual: %#v", m.Tiles)
+  }
+}
@@ -0,0 +1,174 @@
+package cartego
+
+import (
+  "net/http"
+  "sort"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of a latency Histogram.
+var LatencyBuckets = []time.Duration{
+  50 * time.Millisecond,
+  100 * time.Millisecond,
+  250 * time.Millisecond,
+  500 * time.Millisecond,
+  time.Second,
+  2500 * time.Millisecond,
+  5 * time.Second,
+  10 * time.Second,
+}
+
+// A Histogram counts latencies by bucket. Counts[i] holds those up to
+// LatencyBuckets[i]; the extra last bucket holds everything slower.
+type Histogram struct {
+  Counts []int
+  Count int
+  Sum, Max time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+  if h.Counts == nil {
+    h.Counts = make([]int, len(LatencyBuckets)+1)
+  }
+
+  i := sort.Search(len(LatencyBuckets), func(i int) bool {
+    return d <= LatencyBuckets[i]
+  })
+  h.Counts[i]++
+  h.Count++
+  h.Sum += d
+  h.Max = max(h.Max, d)
+}
+
+// Mean returns the average latency.
+func (h Histogram) Mean() time.Duration {
+  if h.Count == 0 {
+    return 0
+  }
+  return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding quantile q (0-1),
+// or Max if that's the last bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+  rank := int(q * float64(h.Count) + 0.5)
+  seen := 0
+  for i, n := range h.Counts {
+    seen += n
+    if seen >= rank && seen > 0 {
+      if i < len(LatencyBuckets) {
+        return min(LatencyBuckets[i], h.Max)
+      }
+      break
+    }
+  }
+  return h.Max
+}
+
+// Stats summarizes the requests made to one host for one strategy.
+type Stats struct {
+  Strategy, Host string
+
+  // Requests counts every attempt, including Retries. Errors counts those
+  // that got no response at all; Status counts responses by status code.
+  Requests, Retries, Errors int
+  Status map[int]int
+
+  // Bytes is the number of body bytes read.
+  Bytes int64
+
+  // Latency is the time until the response headers arrived.
+  Latency Histogram
+}
+
+type metricsKey struct {
+  strategy, host string
+}
+
+type hostMetrics struct {
+  Stats
+  bytes int64
+}
+
+// Metrics collects statistics about the requests of one or more Downloaders.
+// It is safe for concurrent use.
+type Metrics struct {
+  mu sync.Mutex
+  hosts map[metricsKey]*hostMetrics
+}
+
+// get returns the stats for strategy and host; the caller holds m.mu
+func (m *Metrics) get(strategy Strategy, host string) *hostMetrics {
+  if m.hosts == nil {
+    m.hosts = make(map[metricsKey]*hostMetrics)
+  }
+
+  key := metricsKey{StrategyName(strategy), host}
+  h, ok := m.hosts[key]
+  if !ok {
+    h = &hostMetrics{Stats: Stats{Strategy: key.strategy, Host: host, Status: make(map[int]int)}}
+    m.hosts[key] = h
+  }
+  return h
+}
+
+// request records an attempt that took latency to get resp, or nil if it
+// failed, and starts counting the bytes of resp's body
+func (m *Metrics) request(strategy Strategy, host string, latency time.Duration, resp *http.Response) {
+  if m == nil {
+    return
+  }
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  h := m.get(strategy, host)
+  h.Requests++
+  if resp == nil {
+    h.Errors++
+    return
+  }
+
+  h.Status[resp.StatusCode]++
+  h.Latency.observe(latency)
+  resp.Body = &countingBody{resp.Body, &h.bytes}
+}
+
+func (m *Metrics) retry(strategy Strategy, host string) {
+  if m == nil {
+    return
+  }
+
+  m.mu.Lock()
+  m.get(strategy, host).Retries++
+  m.mu.Unlock()
+}
+
+// Snapshot returns a copy of the statistics so far, sorted by strategy and
+// host.
+func (m *Metrics) Snapshot() []Stats {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  ret := make([]Stats, 0, len(m.hosts))
+  for _, h := range m.hosts {
+    s := h.Stats
+    s.Bytes = atomic.LoadInt64(&h.bytes)
+    s.Status = make(map[int]int, len(h.Status))
+    for code, n := range h.Status {
+      s.Status[code] = n
+    }
+    s.Latency.Counts = append([]int(nil), h.Latency.Counts...)
+    ret = append(ret, s)
+  }
+
+  sort.Slice(ret, func(i, j int) bool {
+    if ret[i].Strategy != ret[j].Strategy {
+      return ret[i].Strategy < ret[j].Strategy
+    }
+    return ret[i].Host < ret[j].Host
+  })
+  return ret
+}
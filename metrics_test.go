@@ -0,0 +1,68 @@
+package cartego
+
+import (
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestMetrics(t *testing.T) {
+  var hits int64
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if atomic.AddInt64(&hits, 1) == 1 {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    io.WriteString(w, "tile")
+  }))
+  defer s.Close()
+
+  m := &Metrics{}
+  d := &Downloader{Strategy: testStrategy{s.URL}, Retries: 1, RetryWait: time.Millisecond, Metrics: m}
+  for image := range d.Download(testTiles(1)) {
+    io.ReadAll(image.Buf)
+  }
+
+  stats := m.Snapshot()
+  if len(stats) != 1 {
+    t.Fatalf("expected stats for one host; actual: %#v", stats)
+  }
+
+  st := stats[0]
+  u, _ := url.Parse(s.URL)
+  if st.Host != u.Host || st.Strategy != "cartego.testStrategy" {
+    t.Errorf("unexpected strategy or host: %q, %q", st.Strategy, st.Host)
+  }
+  if st.Requests != 2 || st.Retries != 1 || st.Errors != 0 {
+    t.Errorf("expected 2 requests, 1 retry; actual: %#v", st)
+  }
+  if st.Status[200] != 1 || st.Status[503] != 1 {
+    t.Errorf("expected one 200 and one 503; actual: %v", st.Status)
+  }
+  if st.Bytes != 4 {
+    t.Errorf("expected 4 bytes; actual: %d", st.Bytes)
+  }
+  if st.Latency.Count != 2 || st.Latency.Quantile(0.5) > st.Latency.Max {
+    t.Errorf("unexpected latency histogram: %#v", st.Latency)
+  }
+}
+
+func TestHistogramQuantile(t *testing.T) {
+  var h Histogram
+  for i := 0; i < 9; i++ {
+    h.observe(20 * time.Millisecond)
+  }
+  h.observe(3 * time.Second)
+
+  // quantiles are only as precise as the buckets
+  if q := h.Quantile(0.5); q != 50*time.Millisecond {
+    t.Errorf("expected a median of up to 50ms; actual: %v", q)
+  }
+  if q := h.Quantile(0.99); q != 3*time.Second {
+    t.Errorf("expected a 99th percentile of 3s; actual: %v", q)
+  }
+}
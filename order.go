@@ -0,0 +1,321 @@
+package cartego
+
+import (
+  "slices"
+  "sort"
+)
+
+// An Order is a sequence in which to download tiles. Apart from GivenOrder,
+// every order finishes a zoom level before starting the next, lowest first,
+// so an interrupted download still has full coverage at the lower levels.
+type Order int
+
+const (
+  // GivenOrder leaves tiles in the order they were supplied.
+  GivenOrder Order = iota
+
+  // ZoomOrder goes column by column through each zoom level, like
+  // GetTileCoords does.
+  ZoomOrder
+
+  // SpiralOrder starts at the center of each zoom level and works outwards
+  // ring by ring, so the tiles around the point of interest come first.
+  SpiralOrder
+
+  // HilbertOrder follows a Hilbert curve through each zoom level, so tiles
+  // that follow each other are also close together on the map.
+  HilbertOrder
+)
+
+// tileRect is the inclusive range of tiles from (X0, Y0) to (X1, Y1) at a
+// single zoom level
+type tileRect struct {
+  Zoom, X0, Y0, X1, Y1 int
+}
+
+func (r tileRect) contains(x, y int) bool {
+  return x >= r.X0 && x <= r.X1 && y >= r.Y0 && y <= r.Y1
+}
+
+func (r tileRect) center() (int, int) {
+  return (r.X0 + r.X1) / 2, (r.Y0 + r.Y1) / 2
+}
+
+// unwrap returns r with its columns running east from X0 to X1 without a
+// jump, which for a rect crossing the antimeridian takes X1 past the east
+// edge of the map. It is never wider than the map.
+func (r tileRect) unwrap() tileRect {
+  n := 1 << uint(r.Zoom)
+  if r.X1 < r.X0 {
+    r.X1 += n
+  }
+  r.X1 = min(r.X1, r.X0 + n - 1)
+  return r
+}
+
+// wrapX returns the column of the map that x falls in, for x east or west of
+// the map's edges
+func wrapX(x, zoom int) int {
+  n := 1 << uint(zoom)
+  return ((x % n) + n) % n
+}
+
+// hilbertSide is the side of the smallest Hilbert curve covering r
+func (r tileRect) hilbertSide() int {
+  n := 1
+  for n < r.X1-r.X0+1 || n < r.Y1-r.Y0+1 {
+    n *= 2
+  }
+  return n
+}
+
+// key returns the position of (x, y) when walking r in order o
+func (o Order) key(r tileRect, x, y int) int64 {
+  switch o {
+  case SpiralOrder:
+    return spiralIndex(r, x, y)
+  case HilbertOrder:
+    return hilbertIndex(r.hilbertSide(), x-r.X0, y-r.Y0)
+  }
+  return int64(x-r.X0) * int64(r.Y1-r.Y0+1) + int64(y-r.Y0)
+}
+
+// spiralIndex numbers the tiles around the center of r ring by ring. Each
+// ring starts at its top left corner and goes clockwise.
+func spiralIndex(r tileRect, x, y int) int64 {
+  cx, cy := r.center()
+  ring := max(abs(x-cx), abs(y-cy))
+  if ring == 0 {
+    return 0
+  }
+
+  // tiles in all of the rings inside this one
+  start := int64(2*ring-1) * int64(2*ring-1)
+
+  var pos int
+  switch {
+  case y == cy-ring:
+    pos = x - (cx - ring)
+  case x == cx+ring:
+    pos = 2*ring + y - (cy - ring)
+  case y == cy+ring:
+    pos = 4*ring + (cx + ring) - x
+  default:
+    pos = 6*ring + (cy + ring) - y
+  }
+  return start + int64(pos)
+}
+
+// hilbertIndex returns the distance of (x, y) along a Hilbert curve filling an
+// n×n square, where n is a power of two
+func hilbertIndex(n, x, y int) (d int64) {
+  for s := n / 2; s > 0; s /= 2 {
+    var rx, ry int
+    if x&s > 0 {
+      rx = 1
+    }
+    if y&s > 0 {
+      ry = 1
+    }
+    d += int64(s) * int64(s) * int64((3*rx)^ry)
+    x, y = hilbertRotate(n, x, y, rx, ry)
+  }
+  return d
+}
+
+// hilbertPoint is the inverse of hilbertIndex
+func hilbertPoint(n int, d int64) (x, y int) {
+  for s := 1; s < n; s *= 2 {
+    rx := int(1 & (d / 2))
+    ry := int(1 & (d ^ int64(rx)))
+    x, y = hilbertRotate(s, x, y, rx, ry)
+    x += s * rx
+    y += s * ry
+    d /= 4
+  }
+  return x, y
+}
+
+func hilbertRotate(n, x, y, rx, ry int) (int, int) {
+  if ry == 0 {
+    if rx == 1 {
+      x = n - 1 - x
+      y = n - 1 - y
+    }
+    x, y = y, x
+  }
+  return x, y
+}
+
+// walk yields the tiles of r in order o, the same order SortTiles would put
+// them in, without holding them all in memory. It returns false if yield did.
+// A rect crossing the antimeridian is walked as one, with columns wrapped
+// back onto the map as they're yielded.
+func (o Order) walk(r tileRect, yield func(Tile) bool) bool {
+  r = r.unwrap()
+  if r.X0 < 0 || r.X1 >= 1 << uint(r.Zoom) {
+    unwrapped := yield
+    yield = func(t Tile) bool {
+      t.X = wrapX(t.X, t.Zoom)
+      return unwrapped(t)
+    }
+  }
+
+  switch o {
+  case SpiralOrder:
+    return walkSpiral(r, yield)
+  case HilbertOrder:
+    n := r.hilbertSide()
+    return walkHilbert(r, n, 0, n, yield)
+  }
+
+  for x := r.X0; x <= r.X1; x++ {
+    for y := r.Y0; y <= r.Y1; y++ {
+      if !yield(Tile{X: x, Y: y, Zoom: r.Zoom}) {
+        return false
+      }
+    }
+  }
+  return true
+}
+
+func walkSpiral(r tileRect, yield func(Tile) bool) bool {
+  cx, cy := r.center()
+  rings := max(cx-r.X0, r.X1-cx, cy-r.Y0, r.Y1-cy)
+
+  emit := func(x, y int) bool {
+    return yield(Tile{X: x, Y: y, Zoom: r.Zoom})
+  }
+
+  if !emit(cx, cy) {
+    return false
+  }
+
+  // each side of a ring is clipped to r rather than checking every tile
+  for ring := 1; ring <= rings; ring++ {
+    top, right, bottom, left := cy-ring, cx+ring, cy+ring, cx-ring
+
+    if top >= r.Y0 {
+      for x := max(left, r.X0); x <= min(right, r.X1); x++ {
+        if !emit(x, top) {
+          return false
+        }
+      }
+    }
+    if right <= r.X1 {
+      for y := max(top+1, r.Y0); y <= min(bottom, r.Y1); y++ {
+        if !emit(right, y) {
+          return false
+        }
+      }
+    }
+    if bottom <= r.Y1 {
+      for x := min(right-1, r.X1); x >= max(left, r.X0); x-- {
+        if !emit(x, bottom) {
+          return false
+        }
+      }
+    }
+    if left >= r.X0 {
+      for y := min(bottom-1, r.Y1); y >= max(top+1, r.Y0); y-- {
+        if !emit(left, y) {
+          return false
+        }
+      }
+    }
+  }
+  return true
+}
+
+// walkHilbert yields the part of the curve of side n from index d covering a
+// side×side square. Squares that miss r are skipped as a whole.
+func walkHilbert(r tileRect, n int, d int64, side int, yield func(Tile) bool) bool {
+  x, y := hilbertPoint(n, d)
+  x, y = r.X0 + x&^(side-1), r.Y0 + y&^(side-1)
+  if x > r.X1 || y > r.Y1 {
+    return true
+  }
+
+  if side == 1 {
+    return yield(Tile{X: x, Y: y, Zoom: r.Zoom})
+  }
+
+  quarter := int64(side/2) * int64(side/2)
+  for i := int64(0); i < 4; i++ {
+    if !walkHilbert(r, n, d+i*quarter, side/2, yield) {
+      return false
+    }
+  }
+  return true
+}
+
+func abs(n int) int {
+  if n < 0 {
+    return -n
+  }
+  return n
+}
+
+// SortTiles puts tiles in order o. Tiles at each zoom level are ordered
+// within the smallest rectangle that holds them all, which may cross the
+// antimeridian.
+func SortTiles(tiles []Tile, o Order) {
+  if o == GivenOrder || len(tiles) == 0 {
+    return
+  }
+
+  rects := make(map[int]tileRect)
+  columns := make(map[int][]int)
+  for _, t := range tiles {
+    r, ok := rects[t.Zoom]
+    if !ok {
+      r = tileRect{t.Zoom, t.X, t.Y, t.X, t.Y}
+    }
+    r.Y0, r.Y1 = min(r.Y0, t.Y), max(r.Y1, t.Y)
+    rects[t.Zoom] = r
+    columns[t.Zoom] = append(columns[t.Zoom], t.X)
+  }
+  for zoom, xs := range columns {
+    r := rects[zoom]
+    r.X0, r.X1 = spanColumns(zoom, xs)
+    rects[zoom] = r
+  }
+
+  keys := make(map[Tile]int64, len(tiles))
+  for _, t := range tiles {
+    r := rects[t.Zoom]
+    x := t.X
+    if x < r.X0 {
+      x += 1 << uint(t.Zoom)
+    }
+    keys[t] = o.key(r, x, t.Y)
+  }
+
+  sort.SliceStable(tiles, func(i, j int) bool {
+    if tiles[i].Zoom != tiles[j].Zoom {
+      return tiles[i].Zoom < tiles[j].Zoom
+    }
+    return keys[tiles[i]] < keys[tiles[j]]
+  })
+}
+
+// spanColumns returns the narrowest range of columns from x0 east to x1
+// holding all of xs. The range leaves out the widest gap between the
+// columns, so where that is in the middle of the map, the range crosses the
+// antimeridian and x1 lies past the east edge of the map.
+func spanColumns(zoom int, xs []int) (x0, x1 int) {
+  slices.Sort(xs)
+  xs = slices.Compact(xs)
+  n := 1 << uint(zoom)
+
+  // the gap across the antimeridian, which leaves the range unwrapped
+  x0, x1 = xs[0], xs[len(xs)-1]
+  gap := xs[0] + n - xs[len(xs)-1]
+  for i := 1; i < len(xs); i++ {
+    if xs[i] - xs[i-1] > gap {
+      gap = xs[i] - xs[i-1]
+      x0, x1 = xs[i], xs[i-1] + n
+    }
+  }
+  return x0, x1
+}
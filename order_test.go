@@ -0,0 +1,106 @@
+package cartego
+
+import (
+  "testing"
+)
+
+type orderTest struct {
+  order Order
+  tiles, expected []Tile
+}
+
+func square(zoom, x0, y0, side int) (ret []Tile) {
+  for x := x0; x < x0+side; x++ {
+    for y := y0; y < y0+side; y++ {
+      ret = append(ret, Tile{X: x, Y: y, Zoom: zoom})
+    }
+  }
+  return ret
+}
+
+func TestSortTiles(t *testing.T) {
+  tests := []orderTest{
+    orderTest{SpiralOrder, square(5, 10, 20, 3), []Tile{
+        Tile{11, 21, 5},
+        Tile{10, 20, 5}, Tile{11, 20, 5}, Tile{12, 20, 5},
+        Tile{12, 21, 5}, Tile{12, 22, 5}, Tile{11, 22, 5},
+        Tile{10, 22, 5}, Tile{10, 21, 5},
+      },
+    },
+    orderTest{HilbertOrder, square(5, 10, 20, 2), []Tile{
+        Tile{10, 20, 5}, Tile{10, 21, 5}, Tile{11, 21, 5}, Tile{11, 20, 5},
+      },
+    },
+    orderTest{ZoomOrder, append(square(3, 0, 0, 1), square(2, 1, 1, 1)...), []Tile{
+        Tile{1, 1, 2}, Tile{0, 0, 3},
+      },
+    },
+  }
+
+  for _, test := range tests {
+    tiles := append([]Tile(nil), test.tiles...)
+    // start from the reverse so nothing passes by accident
+    for i, j := 0, len(tiles)-1; i < j; i, j = i+1, j-1 {
+      tiles[i], tiles[j] = tiles[j], tiles[i]
+    }
+
+    SortTiles(tiles, test.order)
+    for i := range tiles {
+      if tiles[i] != test.expected[i] {
+        t.Errorf("order %d; expected: %v; actual: %v", test.order, test.expected, tiles)
+        break
+      }
+    }
+  }
+}
+
+func TestHilbertIndexCoversSquare(t *testing.T) {
+  n := 8
+  seen := make(map[int64]bool)
+  for x := 0; x < n; x++ {
+    for y := 0; y < n; y++ {
+      d := hilbertIndex(n, x, y)
+      if d < 0 || d >= int64(n*n) || seen[d] {
+        t.Fatalf("bad or repeated index %d for %d,%d", d, x, y)
+      }
+      seen[d] = true
+    }
+  }
+}
+
+func TestWalkMatchesSortTiles(t *testing.T) {
+  rects := []tileRect{
+    tileRect{7, 3, 5, 9, 8},
+    tileRect{7, 0, 0, 0, 4},
+    tileRect{7, 10, 10, 14, 14},
+    // across the antimeridian
+    tileRect{7, 124, 2, 130, 6},
+  }
+
+  for _, o := range []Order{ZoomOrder, SpiralOrder, HilbertOrder} {
+    for _, r := range rects {
+      var walked, sorted []Tile
+      o.walk(r, func(t Tile) bool {
+        walked = append(walked, t)
+        return true
+      })
+      for x := r.X0; x <= r.X1; x++ {
+        for y := r.Y0; y <= r.Y1; y++ {
+          sorted = append(sorted, Tile{X: wrapX(x, r.Zoom), Y: y, Zoom: r.Zoom})
+        }
+      }
+      SortTiles(sorted, o)
+
+      if len(walked) != len(sorted) {
+        t.Errorf("order %d, %#v: expected %d tiles; actual: %d", o, r, len(sorted), len(walked))
+        continue
+      }
+      for i := range sorted {
+        if walked[i] != sorted[i] {
+          t.Errorf("order %d, %#v: expected: %v; actual: %v", o, r, sorted, walked)
+          break
+        }
+      }
+    }
+  }
+}
@@ -0,0 +1,254 @@
+package cartego
+
+import (
+  "iter"
+  "math"
+  "slices"
+  "sort"
+)
+
+// A Polygon is the area inside its first ring, less any holes given by the
+// rings after it. A ring is a list of points, with or without the first one
+// repeated at the end.
+type Polygon [][]Point
+
+// fpoint is a position in fractional tiles at zoom level 0, so the whole map
+// goes from (0, 0) to (1, 1)
+type fpoint struct {
+  x, y float64
+}
+
+// project converts p to Web Mercator tile coordinates at zoom level 0
+func project(p Point) fpoint {
+  lat := toRad(max(min(p.Lat, MaxLat), -MaxLat))
+  return fpoint{
+    x: (p.Lon + 180) / 360,
+    y: (1 - math.Asinh(math.Tan(lat)) / math.Pi) / 2,
+  }
+}
+
+// a span is the inclusive range of columns from X0 to X1 in a row of tiles
+type span struct {
+  X0, X1 int
+}
+
+// coverage is the tiles within rect that an area covers, as spans of
+// columns for each of its rows
+type coverage struct {
+  rect tileRect
+  rows [][]span
+}
+
+// contains reports whether c covers the tile at (x, y), where x may be east
+// or west of the map
+func (c *coverage) contains(x, y int) bool {
+  if y < c.rect.Y0 || y > c.rect.Y1 {
+    return false
+  }
+  x = wrapX(x, c.rect.Zoom)
+  row := c.rows[y-c.rect.Y0]
+  i := sort.Search(len(row), func(i int) bool { return row[i].X1 >= x })
+  return i < len(row) && row[i].X0 <= x
+}
+
+// add covers the columns from x0 to x1 of row y. Columns east or west of the
+// map are wrapped around onto it, so the spans stay within the map.
+func (c *coverage) add(y, x0, x1 int) {
+  n := 1 << uint(c.rect.Zoom)
+  row := &c.rows[y-c.rect.Y0]
+  if x1 - x0 + 1 >= n {
+    *row = append(*row, span{0, n - 1})
+    return
+  }
+
+  x0, x1 = wrapX(x0, c.rect.Zoom), wrapX(x0, c.rect.Zoom) + x1 - x0
+  if x1 < n {
+    *row = append(*row, span{x0, x1})
+  } else {
+    *row = append(*row, span{x0, n - 1}, span{0, x1 - n})
+  }
+}
+
+// merge sorts the spans of each row, joining the ones that overlap or touch
+func (c *coverage) merge() {
+  for i, row := range c.rows {
+    slices.SortFunc(row, func(a, b span) int { return a.X0 - b.X0 })
+
+    merged := row[:0]
+    for _, s := range row {
+      if n := len(merged); n > 0 && s.X0 <= merged[n-1].X1+1 {
+        merged[n-1].X1 = max(merged[n-1].X1, s.X1)
+      } else {
+        merged = append(merged, s)
+      }
+    }
+    c.rows[i] = merged
+  }
+}
+
+// tileRange is the tiles from floor(a) to the one ending at b, for a <= b,
+// so a range ending exactly on the edge of a tile doesn't spill into the next
+func tileRange(a, b float64) (int, int) {
+  lo := int(math.Floor(a))
+  return lo, max(int(math.Ceil(b)) - 1, lo)
+}
+
+// polygonCoverage works out which tiles at zoom intersect polygons, each
+// given as rings of projected points. A tile intersects a polygon if one of
+// the polygon's edges passes through it, or if it lies inside the polygon,
+// which is decided by the even-odd rule along the middle of each row.
+func polygonCoverage(polygons [][][]fpoint, zoom int) *coverage {
+  n := 1 << uint(zoom)
+  scale := float64(n)
+
+  minX, minY := math.Inf(1), math.Inf(1)
+  maxX, maxY := math.Inf(-1), math.Inf(-1)
+  for _, rings := range polygons {
+    for _, ring := range rings {
+      for _, p := range ring {
+        minX, maxX = min(minX, p.x), max(maxX, p.x)
+        minY, maxY = min(minY, p.y), max(maxY, p.y)
+      }
+    }
+  }
+  if minX > maxX {
+    return nil
+  }
+
+  // columns are only wrapped onto the map at the end, so rect may extend
+  // past its east or west edge
+  x0, x1 := tileRange(minX*scale, maxX*scale)
+  y0, y1 := tileRange(minY*scale, maxY*scale)
+  c := &coverage{rect: tileRect{zoom, x0, max(y0, 0), x1, min(y1, n-1)}.unwrap()}
+  if c.rect.Y0 > c.rect.Y1 {
+    return nil
+  }
+  c.rows = make([][]span, c.rect.Y1-c.rect.Y0+1)
+
+  for _, rings := range polygons {
+    // where the edges cross the middle of each row the polygon is in, which
+    // for the small pieces of a corridor is only a few
+    top, bottom := math.Inf(1), math.Inf(-1)
+    for _, ring := range rings {
+      for _, p := range ring {
+        top, bottom = min(top, p.y), max(bottom, p.y)
+      }
+    }
+    r0, r1 := tileRange(top*scale, bottom*scale)
+    r0, r1 = max(r0, c.rect.Y0), min(r1, c.rect.Y1)
+    if r0 > r1 {
+      continue
+    }
+    crossings := make([][]float64, r1-r0+1)
+
+    for _, ring := range rings {
+      for i := range ring {
+        a, b := ring[i], ring[(i+1) % len(ring)]
+        a.x, a.y, b.x, b.y = a.x*scale, a.y*scale, b.x*scale, b.y*scale
+        xAt := func(y float64) float64 {
+          if a.y == b.y {
+            return a.x
+          }
+          return a.x + (y - a.y) * (b.x - a.x) / (b.y - a.y)
+        }
+
+        lo, hi := min(a.y, b.y), max(a.y, b.y)
+        e0, e1 := tileRange(lo, hi)
+        for r := max(e0, r0); r <= min(e1, r1); r++ {
+          // the tiles the part of the edge in this row passes through
+          xa, xb := xAt(max(lo, float64(r))), xAt(min(hi, float64(r+1)))
+          if a.y == b.y {
+            xa, xb = a.x, b.x
+          }
+          t0, t1 := tileRange(min(xa, xb), max(xa, xb))
+          c.add(r, t0, t1)
+
+          // a vertex on the middle counts for the edge below it only, so
+          // it isn't crossed twice
+          mid := float64(r) + 0.5
+          if (a.y <= mid) != (b.y <= mid) {
+            crossings[r-r0] = append(crossings[r-r0], xAt(mid))
+          }
+        }
+      }
+    }
+
+    for i, xs := range crossings {
+      slices.Sort(xs)
+      for j := 0; j+1 < len(xs); j += 2 {
+        t0, t1 := tileRange(xs[j], xs[j+1])
+        c.add(r0+i, t0, t1)
+      }
+    }
+  }
+
+  c.merge()
+  return c
+}
+
+// projectPolygons projects every point of polygons, once for all zoom levels.
+// An edge more than half way around the world is taken to cross the
+// antimeridian, so points are moved a whole world east or west to keep each
+// ring in one piece, and near the first polygon.
+func projectPolygons(polygons []Polygon) [][][]fpoint {
+  projected := make([][][]fpoint, len(polygons))
+  first := math.NaN()
+  for i, rings := range polygons {
+    // holes start near their outer ring, which starts near the first polygon
+    ref := first
+    for j, ring := range rings {
+      var pr []fpoint
+      for _, p := range ring {
+        fp := project(p)
+        if len(pr) > 0 {
+          fp.x += math.Round(pr[len(pr)-1].x - fp.x)
+        } else if !math.IsNaN(ref) {
+          fp.x += math.Round(ref - fp.x)
+        }
+        pr = append(pr, fp)
+      }
+
+      if j == 0 && len(pr) > 0 {
+        ref = pr[0].x
+        if math.IsNaN(first) {
+          first = ref
+        }
+      }
+      projected[i] = append(projected[i], pr)
+    }
+  }
+  return projected
+}
+
+// walkCoverage yields the tiles intersecting the projected polygons, one zoom
+// level after the other in order o
+func walkCoverage(projected [][][]fpoint, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  return func(yield func(Tile) bool) {
+    for zoom := minZoom; zoom <= maxZoom; zoom++ {
+      c := polygonCoverage(projected, zoom)
+      if c == nil {
+        continue
+      }
+
+      keepGoing := o.walk(c.rect, func(t Tile) bool {
+        return !c.contains(t.X, t.Y) || yield(t)
+      })
+      if !keepGoing {
+        return
+      }
+    }
+  }
+}
+
+// TileCoordsPolygon yields the same tiles as GetTileCoordsPolygon, one zoom
+// level after the other in order o, without building a slice of them.
+func TileCoordsPolygon(polygons []Polygon, minZoom, maxZoom int, o Order) iter.Seq[Tile] {
+  return walkCoverage(projectPolygons(polygons), minZoom, maxZoom, o)
+}
+
+// GetTileCoordsPolygon returns the tiles that intersect any of polygons at
+// each zoom level from minZoom to maxZoom. Together the polygons can describe
+// a GeoJSON Polygon or MultiPolygon.
+func GetTileCoordsPolygon(polygons []Polygon, minZoom, maxZoom int) []Tile {
+  return slices.Collect(TileCoordsPolygon(polygons, minZoom, maxZoom, ZoomOrder))
+}
@@ -0,0 +1,117 @@
+package cartego
+
+import (
+  "math"
+  "testing"
+)
+
+// box is a polygon ring around the given edges, counterclockwise
+func box(south, west, north, east float64) []Point {
+  return []Point{{south, west}, {south, east}, {north, east}, {north, west}}
+}
+
+// segmentHitsSquare reports whether the segment from a to b passes through
+// the unit square with its top left corner at (x, y), by clipping it
+func segmentHitsSquare(a, b fpoint, x, y float64) bool {
+  t0, t1 := 0.0, 1.0
+  dx, dy := b.x - a.x, b.y - a.y
+  for _, edge := range [][2]float64{{-dx, a.x - x}, {dx, x + 1 - a.x}, {-dy, a.y - y}, {dy, y + 1 - a.y}} {
+    p, q := edge[0], edge[1]
+    if p == 0 {
+      if q < 0 {
+        return false
+      }
+      continue
+    }
+    t := q / p
+    if p < 0 {
+      t0 = math.Max(t0, t)
+    } else {
+      t1 = math.Min(t1, t)
+    }
+  }
+  return t0 <= t1
+}
+
+// intersects is a slow reference for whether tile intersects polygon
+func intersects(polygon Polygon, tile Tile) bool {
+  scale := float64(int(1) << uint(tile.Zoom))
+  cx, cy := float64(tile.X) + .5, float64(tile.Y) + .5
+
+  inside := false
+  for _, ring := range polygon {
+    for i := range ring {
+      a, b := project(ring[i]), project(ring[(i+1) % len(ring)])
+      a.x, a.y, b.x, b.y = a.x*scale, a.y*scale, b.x*scale, b.y*scale
+      if segmentHitsSquare(a, b, float64(tile.X), float64(tile.Y)) {
+        return true
+      }
+      if (a.y <= cy) != (b.y <= cy) && cx < a.x + (cy - a.y) * (b.x - a.x) / (b.y - a.y) {
+        inside = !inside
+      }
+    }
+  }
+  return inside
+}
+
+func TestGetTileCoordsPolygon(t *testing.T) {
+  // a box covers the same tiles as GetTileCoordsBBox
+  square := []Polygon{{box(40.3013, -111.7021, 40.3551, -111.6217)}}
+  tiles := GetTileCoordsPolygon(square, 10, 14)
+  expected := GetTileCoordsBBox(40.3013, -111.7021, 40.3551, -111.6217, 10, 14)
+  if !(getTilesTest{expected: expected}).passes(tiles) {
+    t.Errorf("box: expected: %v; actual: %v", expected, tiles)
+  }
+
+  // a hole in the middle takes out the tiles entirely inside it
+  holed := []Polygon{{box(40.3013, -111.7021, 40.3551, -111.6217), box(40.3113, -111.6921, 40.3451, -111.6317)}}
+  tiles = GetTileCoordsPolygon(holed, 14, 14)
+  if len(tiles) == 0 || len(tiles) >= len(GetTileCoordsPolygon(square, 14, 14)) {
+    t.Errorf("hole: expected fewer than the %d tiles without it; actual: %d", len(GetTileCoordsPolygon(square, 14, 14)), len(tiles))
+  }
+  // the tiles on the edge of the hole's box only partly lie inside it
+  hole := bboxRects(40.3113, -111.6921, 40.3451, -111.6317, 14, 14)[0]
+  for _, tile := range tiles {
+    if tile.X > hole.X0 && tile.X < hole.X1 && tile.Y > hole.Y0 && tile.Y < hole.Y1 {
+      t.Errorf("hole: tile %v is inside the hole", tile)
+    }
+  }
+
+  // an L-shaped county, a triangle with a hole and a far away island
+  polygons := []Polygon{
+    {{{40.01, -111.99}, {40.01, -111.41}, {40.23, -111.41}, {40.23, -111.73}, {40.61, -111.73}, {40.61, -111.99}}},
+    {{{39.51, -111.31}, {39.93, -110.87}, {39.62, -110.42}}, {{39.64, -110.91}, {39.68, -110.83}, {39.63, -110.81}}},
+    {box(41.213, -112.513, 41.217, -112.507)},
+  }
+  for zoom := 8; zoom <= 13; zoom++ {
+    got := make(map[Tile]bool)
+    for _, tile := range GetTileCoordsPolygon(polygons, zoom, zoom) {
+      if got[tile] {
+        t.Errorf("zoom %d: tile %v given twice", zoom, tile)
+      }
+      got[tile] = true
+    }
+
+    for _, tile := range GetTileCoordsBBox(39.5, -112.6, 41.3, -110.4, zoom, zoom) {
+      expected := false
+      for _, p := range polygons {
+        expected = expected || intersects(p, tile)
+      }
+      if got[tile] != expected {
+        t.Errorf("zoom %d: tile %v; expected: %v; actual: %v", zoom, tile, expected, got[tile])
+      }
+    }
+  }
+
+  // every order yields the same tiles
+  n := len(GetTileCoordsPolygon(polygons, 8, 12))
+  for _, o := range []Order{ZoomOrder, SpiralOrder, HilbertOrder} {
+    count := 0
+    for range TileCoordsPolygon(polygons, 8, 12, o) {
+      count++
+    }
+    if count != n {
+      t.Errorf("order %d: expected %d tiles; actual: %d", o, n, count)
+    }
+  }
+}
@@ -0,0 +1,135 @@
+package cartego
+
+import (
+  "io"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Progress describes how far along a call to Download is.
+type Progress struct {
+  // Completed and Failed count finished tiles; Remaining those still to go,
+  // or -1 if the total isn't known.
+  Completed, Failed, Remaining int
+
+  // Bytes is the number of body bytes read so far.
+  Bytes int64
+
+  // Rate is the number of tiles finished per second over the last ten
+  // seconds.
+  Rate float64
+
+  // ETA estimates the time until all tiles are finished at the current rate,
+  // or is zero if that isn't known.
+  ETA time.Duration
+}
+
+// rateWindow is how far back Rate looks
+const rateWindow = 10 * time.Second
+
+type progressTracker struct {
+  mu sync.Mutex
+  report func(Progress)
+  start time.Time
+  total int
+  completed, failed int
+  bytes int64
+
+  // when recent tiles finished, oldest first, for the current rate
+  recent []time.Time
+}
+
+func newProgressTracker(report func(Progress), total int) *progressTracker {
+  if report == nil {
+    return nil
+  }
+  return &progressTracker{report: report, start: time.Now(), total: total}
+}
+
+// finished records a tile and reports the new progress. Its body is only
+// read later, so progress is reported again once it has been read to the
+// end, making the last report's Bytes complete.
+func (t *progressTracker) finished(image *Image) {
+  if t == nil {
+    return
+  }
+
+  if image.Buf != nil {
+    image.Buf = &progressBody{ReadCloser: image.Buf, t: t}
+  }
+
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  if image.Err != nil {
+    t.failed++
+  } else {
+    t.completed++
+  }
+
+  now := time.Now()
+  t.recent = append(t.recent, now)
+  t.reportLocked(now)
+}
+
+// reportLocked reports the progress as of now; the caller holds t.mu
+func (t *progressTracker) reportLocked(now time.Time) {
+  p := Progress{
+    Completed: t.completed,
+    Failed: t.failed,
+    Remaining: t.total - t.completed - t.failed,
+    Bytes: atomic.LoadInt64(&t.bytes),
+  }
+  if t.total < 0 {
+    p.Remaining = -1
+  }
+
+  // the rate over the last rateWindow, or since the start if that's sooner
+  i := 0
+  for i < len(t.recent) && now.Sub(t.recent[i]) > rateWindow {
+    i++
+  }
+  t.recent = t.recent[i:]
+  if window := min(now.Sub(t.start), rateWindow).Seconds(); window > 0 && len(t.recent) > 0 {
+    p.Rate = float64(len(t.recent)) / window
+    if p.Remaining >= 0 {
+      p.ETA = time.Duration(float64(p.Remaining) / p.Rate * float64(time.Second))
+    }
+  }
+
+  t.report(p)
+}
+
+// countingBody adds the bytes read from a response body to n
+type countingBody struct {
+  io.ReadCloser
+  n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+  n, err := b.ReadCloser.Read(p)
+  atomic.AddInt64(b.n, int64(n))
+  return n, err
+}
+
+// progressBody counts the bytes of a tile's body and reports once it has
+// been read
+type progressBody struct {
+  io.ReadCloser
+  t *progressTracker
+  done bool
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+  n, err := b.ReadCloser.Read(p)
+  atomic.AddInt64(&b.t.bytes, int64(n))
+  if err == io.EOF && !b.done {
+    b.done = true
+
+    b.t.mu.Lock()
+    b.t.reportLocked(time.Now())
+    b.t.mu.Unlock()
+  }
+  return n, err
+}
@@ -0,0 +1,189 @@
+package cartego
+
+import (
+  "context"
+  "io"
+  "net/url"
+  "sync"
+  "time"
+)
+
+// limiter is a token bucket: it holds up to burst tokens and refills at rate
+// tokens per second.
+type limiter struct {
+  mu sync.Mutex
+  rate float64
+  burst float64
+  tokens float64
+  last time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+  if burst < 1 {
+    burst = 1
+  }
+  return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has
+// to wait before they are actually available
+func (l *limiter) reserve(n float64) time.Duration {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  now := time.Now()
+  l.tokens += now.Sub(l.last).Seconds() * l.rate
+  if l.tokens > l.burst {
+    l.tokens = l.burst
+  }
+  l.last = now
+
+  l.tokens -= n
+  if l.tokens >= 0 {
+    return 0
+  }
+  return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns tokens taken by a reservation that wasn't used
+func (l *limiter) cancel(n float64) {
+  l.mu.Lock()
+  l.tokens += n
+  if l.tokens > l.burst {
+    l.tokens = l.burst
+  }
+  l.mu.Unlock()
+}
+
+// wait blocks until n tokens are available or ctx is done.
+func (l *limiter) wait(ctx context.Context, n float64) error {
+  if l == nil {
+    return nil
+  }
+
+  delay := l.reserve(n)
+  if delay == 0 {
+    return nil
+  }
+
+  t := time.NewTimer(delay)
+  defer t.Stop()
+
+  select {
+  case <-t.C:
+    return nil
+  case <-ctx.Done():
+    l.cancel(n)
+    return ctx.Err()
+  }
+}
+
+// rate limits are shared by every download in the process
+var limits = struct {
+  sync.Mutex
+  hosts map[string]*limiter
+  strategies map[Strategy]*limiter
+}{
+  hosts: make(map[string]*limiter),
+  strategies: make(map[Strategy]*limiter),
+}
+
+// SetHostRateLimit limits requests to host (as it appears in tile URLs, e.g.
+// "a.tile.openstreetmap.org") to rps requests per second with bursts of up to
+// burst requests. The limit applies to every download in the process.
+// An rps of 0 or less removes the limit.
+func SetHostRateLimit(host string, rps float64, burst int) {
+  limits.Lock()
+  defer limits.Unlock()
+
+  if rps <= 0 {
+    delete(limits.hosts, host)
+  } else {
+    limits.hosts[host] = newLimiter(rps, burst)
+  }
+}
+
+// SetStrategyRateLimit is like SetHostRateLimit, but limits all requests made
+// for strategy, whichever hosts its paths point to. For a Failover, each of
+// its strategies gets a limit of its own. Strategies whose type can't be a
+// map key (other than Failover) can't be limited; use SetHostRateLimit.
+func SetStrategyRateLimit(strategy Strategy, rps float64, burst int) {
+  limits.Lock()
+  defer limits.Unlock()
+
+  for _, s := range members(strategy) {
+    if !hashable(s) {
+      continue
+    }
+    if rps <= 0 {
+      delete(limits.strategies, s)
+    } else {
+      limits.strategies[s] = newLimiter(rps, burst)
+    }
+  }
+}
+
+func hostOf(path string) string {
+  if u, err := url.Parse(path); err == nil {
+    return u.Host
+  }
+  return ""
+}
+
+// waitRateLimit blocks until a request for path may be sent using strategy
+func waitRateLimit(ctx context.Context, strategy Strategy, path string) error {
+  host := hostOf(path)
+
+  var sl *limiter
+  limits.Lock()
+  if hashable(strategy) {
+    sl = limits.strategies[strategy]
+  }
+  hl := limits.hosts[host]
+  limits.Unlock()
+
+  if err := sl.wait(ctx, 1); err != nil {
+    return err
+  }
+  return hl.wait(ctx, 1)
+}
+
+// bandwidthBurst is the most bytes read from a body at once when the
+// bandwidth is limited, so one read can't take the whole budget
+const bandwidthBurst = 32 * 1024
+
+// bandwidth returns the limiter shared by all bodies d reads, or nil if
+// d.MaxBandwidth isn't set
+func (d *Downloader) bandwidth() *limiter {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  if d.MaxBandwidth <= 0 {
+    return nil
+  }
+  if d.bandwidthLimit == nil || d.bandwidthLimit.rate != float64(d.MaxBandwidth) {
+    d.bandwidthLimit = newLimiter(float64(d.MaxBandwidth), int(min(d.MaxBandwidth, bandwidthBurst)))
+  }
+  return d.bandwidthLimit
+}
+
+// throttledBody reads from a response body no faster than its limiter allows
+type throttledBody struct {
+  io.ReadCloser
+  ctx context.Context
+  l *limiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+  if len(p) > int(b.l.burst) {
+    p = p[:int(b.l.burst)]
+  }
+
+  n, err := b.ReadCloser.Read(p)
+  if n > 0 {
+    if werr := b.l.wait(b.ctx, float64(n)); werr != nil && err == nil {
+      err = werr
+    }
+  }
+  return n, err
+}
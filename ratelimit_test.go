@@ -0,0 +1,81 @@
+package cartego
+
+import (
+  "context"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestLimiterWait(t *testing.T) {
+  l := newLimiter(20, 2)
+  start := time.Now()
+  for i := 0; i < 6; i++ {
+    if err := l.wait(context.Background(), 1); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // the burst is free, the remaining four take 50ms each
+  if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+    t.Errorf("expected at least 200ms; actual: %v", elapsed)
+  }
+}
+
+func TestLimiterCancel(t *testing.T) {
+  l := newLimiter(1, 1)
+  l.wait(context.Background(), 1)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  if err := l.wait(ctx, 1); err == nil {
+    t.Error("expected the wait to be cancelled")
+  }
+}
+
+func TestHostRateLimit(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer s.Close()
+
+  u, _ := url.Parse(s.URL)
+  SetHostRateLimit(u.Host, 20, 1)
+  defer SetHostRateLimit(u.Host, 0, 0)
+
+  // two downloaders share the host's limit
+  start := time.Now()
+  a := (&Downloader{Strategy: testStrategy{s.URL}, Concurrency: 3}).Download(testTiles(3))
+  b := (&Downloader{Strategy: testStrategy{s.URL}, Concurrency: 3}).Download(testTiles(6)[3:])
+  for range a {
+  }
+  for range b {
+  }
+
+  if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+    t.Errorf("expected at least 250ms; actual: %v", elapsed)
+  }
+}
+
+func TestMaxBandwidth(t *testing.T) {
+  body := strings.Repeat("x", 20000)
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    io.WriteString(w, body)
+  }))
+  defer s.Close()
+
+  // 60000 bytes at 40000 B/s, minus the initial burst of 32 KiB
+  d := &Downloader{Strategy: testStrategy{s.URL}, Concurrency: 3, MaxBandwidth: 40000}
+  start := time.Now()
+  for image := range d.Download(testTiles(3)) {
+    if buf, _ := io.ReadAll(image.Buf); len(buf) != len(body) {
+      t.Errorf("expected %d bytes; actual: %d", len(body), len(buf))
+    }
+  }
+
+  if elapsed := time.Since(start); elapsed < 650*time.Millisecond {
+    t.Errorf("expected at least 680ms; actual: %v", elapsed)
+  }
+}
@@ -0,0 +1,104 @@
+package cartego
+
+import (
+  "fmt"
+  "math/rand"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  defaultRetryWait = time.Second
+  defaultMaxRetryWait = time.Minute
+)
+
+// A RetryError is reported for a tile that still failed after being retried.
+// Errors holds the error of each attempt, in order.
+type RetryError struct {
+  Errors []error
+}
+
+func (e *RetryError) Error() string {
+  msgs := make([]string, len(e.Errors))
+  for i, err := range e.Errors {
+    msgs[i] = fmt.Sprintf("attempt %d: %v", i+1, err)
+  }
+  return fmt.Sprintf("failed after %d attempts (%s)", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetryError) Unwrap() error {
+  if len(e.Errors) == 0 {
+    return nil
+  }
+  return e.Errors[len(e.Errors)-1]
+}
+
+// A StatusError is reported for a response with a non-2xx status code.
+type StatusError struct {
+  Code int
+  Status string
+}
+
+func (e *StatusError) Error() string {
+  return "server responded " + e.Status
+}
+
+// retryable reports whether a request with this outcome is worth repeating
+func retryable(resp *http.Response, err error) bool {
+  if err != nil {
+    return true
+  }
+  return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff returns the delay before retry number n (starting at 1): the base
+// wait doubled for each previous retry, with up to half of it jittered away
+func (d *Downloader) backoff(n int) time.Duration {
+  wait := d.RetryWait
+  if wait <= 0 {
+    wait = defaultRetryWait
+  }
+  max := d.maxRetryWait()
+
+  for i := 1; i < n && wait < max; i++ {
+    wait *= 2
+  }
+  if wait > max {
+    wait = max
+  }
+
+  return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (d *Downloader) maxRetryWait() time.Duration {
+  if d.MaxRetryWait <= 0 {
+    return defaultMaxRetryWait
+  }
+  return d.MaxRetryWait
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+  h := resp.Header.Get("Retry-After")
+  if h == "" {
+    return 0, false
+  }
+
+  if secs, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && secs >= 0 {
+    return time.Duration(secs) * time.Second, true
+  }
+
+  if t, err := http.ParseTime(h); err == nil {
+    d := time.Until(t)
+    if d < 0 {
+      d = 0
+    }
+    return d, true
+  }
+
+  return 0, false
+}
@@ -15,6 +15,29 @@ var Bing Strategy = &bing{}
 var Yahoo Strategy = &yahoo{}
 var Nokia Strategy = &nokia{}
 
+// StrategyName returns a name for strategy: "OpenStreetMaps", "Google", etc.
+// for the built-in strategies, the result of a Name method if it has one, and
+// its type otherwise.
+func StrategyName(strategy Strategy) string {
+	switch strategy {
+	case OpenStreetMaps:
+		return "OpenStreetMaps"
+	case Google:
+		return "Google"
+	case Bing:
+		return "Bing"
+	case Yahoo:
+		return "Yahoo"
+	case Nokia:
+		return "Nokia"
+	}
+
+	if named, ok := strategy.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", strategy)
+}
+
 func init() {
 	// the s param for a Google image string is one of:
 	// ["G", "Ga", "Gal", ..., "Galileo"]
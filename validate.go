@@ -0,0 +1,190 @@
+package cartego
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "fmt"
+  "image"
+  "image/jpeg"
+  "image/png"
+  "io"
+  "strings"
+  "sync"
+)
+
+// A ValidationError is reported for a tile whose body isn't a usable image.
+type ValidationError struct {
+  Reason string
+}
+
+func (e *ValidationError) Error() string {
+  return "invalid tile: " + e.Reason
+}
+
+// placeholders holds the SHA-256 sums of the "no imagery" tiles of each
+// strategy, shared by every download in the process
+var placeholders = struct {
+  sync.Mutex
+  sums map[Strategy]map[[sha256.Size]byte]bool
+}{sums: make(map[Strategy]map[[sha256.Size]byte]bool)}
+
+// RegisterPlaceholder marks the image with the given SHA-256 sum as a
+// placeholder served by strategy where it has no imagery. When validating,
+// such tiles are treated as invalid. For a Failover, the placeholder is
+// registered for each of its strategies. Strategies whose type can't be a
+// map key (other than Failover) are ignored.
+func RegisterPlaceholder(strategy Strategy, sum [sha256.Size]byte) {
+  placeholders.Lock()
+  defer placeholders.Unlock()
+
+  for _, s := range members(strategy) {
+    if !hashable(s) {
+      continue
+    }
+    if placeholders.sums[s] == nil {
+      placeholders.sums[s] = make(map[[sha256.Size]byte]bool)
+    }
+    placeholders.sums[s][sum] = true
+  }
+}
+
+func isPlaceholder(strategy Strategy, buf []byte) bool {
+  if !hashable(strategy) {
+    return false
+  }
+
+  placeholders.Lock()
+  sums := placeholders.sums[strategy]
+  placeholders.Unlock()
+  if len(sums) == 0 {
+    return false
+  }
+  return sums[sha256.Sum256(buf)]
+}
+
+// sniff returns the content type matching the magic bytes of buf
+func sniff(buf []byte) string {
+  switch {
+  case bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+    return "image/png"
+  case bytes.HasPrefix(buf, []byte("\xff\xd8\xff")):
+    return "image/jpeg"
+  }
+  return ""
+}
+
+// decodeTile checks that buf is a complete image, that it is what the
+// declared content type says it is, and that it isn't a placeholder. It
+// returns the image and its actual content type.
+func decodeTile(strategy Strategy, declared string, buf []byte) (image.Image, string, error) {
+  actual := sniff(buf)
+  if actual == "" {
+    return nil, "", &ValidationError{"not a PNG or JPEG image"}
+  }
+
+  declared, _, _ = strings.Cut(declared, ";")
+  declared = strings.TrimSpace(strings.ToLower(declared))
+  switch declared {
+  case "image/png", "image/jpeg", "image/jpg":
+    if declared != actual && !(declared == "image/jpg" && actual == "image/jpeg") {
+      return nil, "", &ValidationError{fmt.Sprintf("content type %s, but the data is %s", declared, actual)}
+    }
+  }
+
+  var img image.Image
+  var err error
+  if actual == "image/png" {
+    img, err = png.Decode(bytes.NewReader(buf))
+  } else {
+    img, err = jpeg.Decode(bytes.NewReader(buf))
+  }
+  if err != nil {
+    return nil, "", &ValidationError{"can't decode image: " + err.Error()}
+  }
+
+  if isPlaceholder(strategy, buf) {
+    return nil, "", &ValidationError{"provider placeholder image"}
+  }
+  return img, actual, nil
+}
+
+// validate checks the body of a downloaded image, replacing it with an error
+// or, if d.Overzoom allows, with part of a lower zoom level's tile
+func (d *Downloader) validate(ctx context.Context, strategy Strategy, img *Image) *Image {
+  if img.Err != nil || img.Buf == nil {
+    return img
+  }
+
+  buf, err := d.readBody(img)
+  if err != nil {
+    img.Err = err
+    return img
+  }
+
+  _, typ, err := decodeTile(strategy, img.Type, buf)
+  if err == nil {
+    img.Type = typ
+    return img
+  }
+
+  img.Close()
+  img.Buf = nil
+  img.Err = err
+  for levels := 1; levels <= d.Overzoom && levels <= img.Tile.Zoom; levels++ {
+    if d.overzoom(ctx, strategy, img, levels) {
+      break
+    }
+  }
+  return img
+}
+
+// overzoom tries to fill in img from the tile levels zoom levels above it,
+// scaling up the part that covers img's tile
+func (d *Downloader) overzoom(ctx context.Context, strategy Strategy, img *Image, levels int) bool {
+  t := img.Tile
+  parent := Tile{X: t.X >> uint(levels), Y: t.Y >> uint(levels), Zoom: t.Zoom - levels}
+
+  p := d.fetchShared(ctx, strategy, getPath(strategy, parent, 0), parent)
+  if p.Err != nil || p.Buf == nil {
+    p.Close()
+    return false
+  }
+  buf, err := d.readBody(p)
+  if err != nil {
+    return false
+  }
+
+  src, _, err := decodeTile(strategy, p.Type, buf)
+  if err != nil {
+    return false
+  }
+
+  // the part of the parent covering t, scaled up to the parent's size
+  b := src.Bounds()
+  n := 1 << uint(levels)
+  w, h := b.Dx()/n, b.Dy()/n
+  if w == 0 || h == 0 {
+    return false
+  }
+  x0 := b.Min.X + (t.X % n) * w
+  y0 := b.Min.Y + (t.Y % n) * h
+
+  dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+  for y := 0; y < b.Dy(); y++ {
+    for x := 0; x < b.Dx(); x++ {
+      dst.Set(x, y, src.At(x0 + x*w/b.Dx(), y0 + y*h/b.Dy()))
+    }
+  }
+
+  var out bytes.Buffer
+  if err := png.Encode(&out, dst); err != nil {
+    return false
+  }
+
+  img.Buf = io.NopCloser(&out)
+  img.Type = "image/png"
+  img.Err = nil
+  img.Overzoomed = levels
+  return true
+}
@@ -0,0 +1,108 @@
+package cartego
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "errors"
+  "image"
+  "image/color"
+  "image/png"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// quadrants is a tile with a different color in each quarter
+func quadrants() []byte {
+  img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+  colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 0, 255}}
+  for y := 0; y < 256; y++ {
+    for x := 0; x < 256; x++ {
+      img.Set(x, y, colors[(y/128)*2 + x/128])
+    }
+  }
+
+  var buf bytes.Buffer
+  png.Encode(&buf, img)
+  return buf.Bytes()
+}
+
+type validateTest struct {
+  contentType string
+  body []byte
+  valid bool
+}
+
+func TestValidate(t *testing.T) {
+  tile := quadrants()
+  placeholder := append(quadrants(), []byte("no imagery")...)
+
+  tests := []validateTest{
+    validateTest{"image/png", tile, true},
+    validateTest{"", tile, true},
+    validateTest{"image/png", tile[:len(tile)/2], false},
+    validateTest{"image/jpeg", tile, false},
+    validateTest{"text/html", []byte("<html>error</html>"), false},
+    validateTest{"image/png", placeholder, false},
+  }
+
+  var test validateTest
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", test.contentType)
+    w.Write(test.body)
+  }))
+  defer s.Close()
+
+  strategy := &testStrategy{s.URL}
+  RegisterPlaceholder(strategy, sha256.Sum256(placeholder))
+
+  for _, test = range tests {
+    d := &Downloader{Strategy: strategy, Validate: true}
+    image := <-d.Download(testTiles(1))
+
+    var verr *ValidationError
+    if test.valid && image.Err != nil {
+      t.Errorf("given: %q; unexpected error: %v", test.contentType, image.Err)
+    } else if !test.valid && !errors.As(image.Err, &verr) {
+      t.Errorf("given: %q; expected a ValidationError; actual: %v", test.contentType, image.Err)
+    }
+    if test.valid && image.Type != "image/png" {
+      t.Errorf("given: %q; expected type image/png; actual: %q", test.contentType, image.Type)
+    }
+  }
+}
+
+func TestOverzoom(t *testing.T) {
+  s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if strings.HasPrefix(r.URL.Path, "/9/") {
+      w.Write(quadrants())
+    } else {
+      io.WriteString(w, "not an image")
+    }
+  }))
+  defer s.Close()
+
+  d := &Downloader{Strategy: testStrategy{s.URL}, Validate: true, Overzoom: 2}
+  res := <-d.Download([]Tile{Tile{X: 3, Y: 0, Zoom: 10}})
+  if res.Err != nil {
+    t.Fatalf("unexpected error: %v", res.Err)
+  }
+  if res.Overzoomed != 1 {
+    t.Errorf("expected the tile from 1 level up; actual: %d", res.Overzoomed)
+  }
+
+  img, err := png.Decode(res.Buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // tile 3,0 is the top right quarter of tile 1,0 one level up
+  if r, g, b, _ := img.At(200, 200).RGBA(); r>>8 != 0 || g>>8 != 255 || b>>8 != 0 {
+    t.Errorf("expected the green quarter; actual: %v", img.At(200, 200))
+  }
+  if img.Bounds().Dx() != 256 {
+    t.Errorf("expected a 256 pixel tile; actual: %v", img.Bounds())
+  }
+}